@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/hashicorp/nomad/api"
+	"github.com/markpash/nomad-task-updates/pkg/scanner"
+)
+
+// applyUpdates prints the jobs that would be updated to their latest image
+// tags and, unless dryRun is set, registers the updated jobs. Jobs and tasks
+// that can't be updated are skipped and returned as a combined error once the
+// others are registered.
+func applyUpdates(w io.Writer, client *api.Client, results []scanner.Result, dryRun bool) error {
+	updates := scanner.PlanUpdates(results)
+	if len(updates) == 0 {
+		fmt.Fprintln(w, "No updates to apply.")
+		return nil
+	}
+
+	var errs []error
+	for _, update := range updates {
+		fmt.Fprintf(w, "%s/%s:\n", update.Namespace, update.Job)
+		for _, task := range update.Tasks {
+			fmt.Fprintf(w, "  %s/%s: %s:%s -> %s:%s\n", task.Group, task.Task, task.Image, task.FromTag, task.Image, task.ToTag)
+		}
+
+		if dryRun {
+			continue
+		}
+
+		plan, err := scanner.PlanUpdate(client, update)
+		if err != nil {
+			fmt.Fprintf(w, "  skipped: %v\n", err)
+			errs = append(errs, fmt.Errorf("updating job %s/%s: %w", update.Namespace, update.Job, err))
+			continue
+		}
+		for _, skipped := range plan.Skipped {
+			fmt.Fprintf(w, "  skipped %v\n", skipped)
+			errs = append(errs, fmt.Errorf("updating job %s/%s: %w", update.Namespace, update.Job, skipped))
+		}
+		if len(plan.Changes) == 0 {
+			continue
+		}
+
+		if err := scanner.RegisterPlan(client, plan); err != nil {
+			fmt.Fprintf(w, "  not registered: %v\n", err)
+			errs = append(errs, fmt.Errorf("updating job %s/%s: %w", update.Namespace, update.Job, err))
+			continue
+		}
+		fmt.Fprintln(w, "  registered")
+	}
+
+	if dryRun {
+		fmt.Fprintln(w, "Dry run: rerun with -dry-run=false to register the updated jobs.")
+	}
+
+	return errors.Join(errs...)
+}
+
+// planUpdates prints, as a diff grouped by job, how the images of the jobs
+// would change when applying the updates. Nothing is registered. Jobs and
+// tasks that couldn't be updated are listed and returned as a combined error.
+func planUpdates(w io.Writer, client *api.Client, results []scanner.Result) error {
+	updates := scanner.PlanUpdates(results)
+	if len(updates) == 0 {
+		fmt.Fprintln(w, "No updates to apply.")
+		return nil
+	}
+
+	var errs []error
+	for _, update := range updates {
+		plan, err := scanner.PlanUpdate(client, update)
+		if err != nil {
+			fmt.Fprintf(w, "! job %s/%s skipped: %v\n", update.Namespace, update.Job, err)
+			errs = append(errs, fmt.Errorf("planning job %s/%s: %w", update.Namespace, update.Job, err))
+			continue
+		}
+
+		fmt.Fprintf(w, "~ job %s/%s (modify index %d)\n", update.Namespace, update.Job, plan.ModifyIndex)
+		for _, change := range plan.Changes {
+			fmt.Fprintf(w, "    task %s/%s\n", change.Group, change.Task)
+			fmt.Fprintf(w, "    - image: %s\n", change.From)
+			fmt.Fprintf(w, "    + image: %s\n", change.To)
+		}
+		for _, skipped := range plan.Skipped {
+			fmt.Fprintf(w, "    ! %v\n", skipped)
+			errs = append(errs, fmt.Errorf("planning job %s/%s: %w", update.Namespace, update.Job, skipped))
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/markpash/nomad-task-updates/pkg/scanner"
+	"github.com/olekukonko/tablewriter"
+)
+
+// Kinds of changes between two scans.
+const (
+	changeUpdateAvailable = "update-available"
+	changeUpdated         = "updated"
+	changeAdded           = "added"
+	changeRemoved         = "removed"
+)
+
+// resultChange is a task that changed between two scans. From and To are the
+// running version before and after, except for new updates whose To is the
+// latest version.
+type resultChange struct {
+	Change    string `json:"change"`
+	Namespace string `json:"namespace"`
+	Job       string `json:"job"`
+	Group     string `json:"group"`
+	Task      string `json:"task"`
+	Image     string `json:"image"`
+	From      string `json:"from"`
+	To        string `json:"to"`
+}
+
+// diffScans compares the results to those saved in the state file by the
+// previous run, writes the changes and saves the results for the next run.
+// The first run only saves the results.
+func diffScans(w io.Writer, opts options, path string, results []scanner.Result, partial *scanner.PartialError) error {
+	previous, err := loadState(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		slog.Info("no previous scan to compare with, saving this one", "path", path)
+		return saveState(path, results)
+	} else if err != nil {
+		return err
+	}
+
+	// Tasks of images whose tags couldn't be listed this time are missing
+	// from the results, but haven't disappeared.
+	failed := make(map[string]bool)
+	if partial != nil {
+		for _, imageErr := range partial.Images {
+			failed[imageErr.Image] = true
+		}
+	}
+
+	changes, kept := diffResults(previous, results, failed)
+	if err := saveState(path, append(results, kept...)); err != nil {
+		return err
+	}
+
+	return renderChanges(w, opts, changes)
+}
+
+// diffResults returns the changes from previous to current, along with the
+// previous results of failed images, which are carried over to the next run.
+func diffResults(previous, current []scanner.Result, failed map[string]bool) ([]resultChange, []scanner.Result) {
+	change := func(kind string, result scanner.Result, from, to string) resultChange {
+		return resultChange{
+			Change:    kind,
+			Namespace: result.Namespace,
+			Job:       result.Job,
+			Group:     result.Group,
+			Task:      result.Task,
+			Image:     result.Image,
+			From:      from,
+			To:        to,
+		}
+	}
+
+	previousByKey := make(map[string]scanner.Result, len(previous))
+	for _, result := range previous {
+		previousByKey[resultKey(result)] = result
+	}
+
+	changes := make([]resultChange, 0)
+	seen := make(map[string]bool, len(current))
+	for _, result := range current {
+		key := resultKey(result)
+		seen[key] = true
+
+		prev, ok := previousByKey[key]
+		switch {
+		case !ok:
+			changes = append(changes, change(changeAdded, result, "", result.Current))
+		case prev.Current != result.Current:
+			changes = append(changes, change(changeUpdated, result, prev.Current, result.Current))
+		case result.UpdateAvailable && (!prev.UpdateAvailable || prev.Latest != result.Latest):
+			changes = append(changes, change(changeUpdateAvailable, result, result.Current, result.Latest))
+		}
+	}
+
+	var kept []scanner.Result
+	for _, result := range previous {
+		key := resultKey(result)
+		switch {
+		case seen[key]:
+		case failed[result.Image]:
+			kept = append(kept, result)
+		default:
+			changes = append(changes, change(changeRemoved, result, result.Current, ""))
+		}
+		seen[key] = true
+	}
+
+	return changes, kept
+}
+
+func loadState(path string) ([]scanner.Result, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []scanner.Result
+	if err := json.Unmarshal(data, &results); err != nil {
+		return nil, fmt.Errorf("reading state file %s: %w", path, err)
+	}
+	return results, nil
+}
+
+// saveState writes the results to a temporary file first so that an
+// interrupted run doesn't leave a truncated state file behind.
+func saveState(path string, results []scanner.Result) error {
+	data, err := json.MarshalIndent(results, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+func renderChanges(w io.Writer, opts options, changes []resultChange) error {
+	header := []string{"Change", "Namespace", "Job", "Group", "Task", "Image", "From", "To"}
+	rows := make([][]string, 0, len(changes))
+	for _, c := range changes {
+		rows = append(rows, []string{c.Change, c.Namespace, c.Job, c.Group, c.Task, c.Image, c.From, c.To})
+	}
+
+	switch opts.format {
+	case formatJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(changes)
+	case formatCSV:
+		writer := csv.NewWriter(w)
+		if err := writer.Write(header); err != nil {
+			return err
+		}
+		return writer.WriteAll(rows)
+	default:
+		if len(changes) == 0 {
+			_, err := fmt.Fprintln(w, "No changes since the previous scan.")
+			return err
+		}
+
+		table := tablewriter.NewWriter(w)
+		table.SetHeader(header)
+		table.AppendBulk(rows)
+		table.Render()
+		return nil
+	}
+}
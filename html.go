@@ -0,0 +1,68 @@
+package main
+
+import (
+	"html/template"
+	"io"
+	"time"
+
+	"github.com/markpash/nomad-task-updates/pkg/scanner"
+)
+
+// htmlTemplate is a standalone page with inline CSS, so that it can be
+// published as is.
+var htmlTemplate = template.Must(template.New("results").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Nomad task updates</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.6em; text-align: left; }
+th { background: #eee; }
+tr.update td { background: #fde2e2; }
+footer { margin-top: 1em; color: #666; font-size: 0.9em; }
+</style>
+</head>
+<body>
+<h1>Nomad task updates</h1>
+<table>
+<thead>
+<tr>{{range .Header}}<th>{{.}}</th>{{end}}</tr>
+</thead>
+<tbody>
+{{- range .Rows}}
+<tr{{if .Update}} class="update"{{end}}>{{range .Cells}}<td>{{.}}</td>{{end}}</tr>
+{{- end}}
+</tbody>
+</table>
+<footer>Generated {{.Generated.Format "2006-01-02 15:04:05 MST"}}</footer>
+</body>
+</html>
+`))
+
+// renderHTML writes the table rows as a standalone HTML page, highlighting
+// the tasks with an update available.
+func renderHTML(w io.Writer, results []scanner.Result, opts options) error {
+	header, rows := tableRows(results, opts)
+
+	type htmlRow struct {
+		Cells  []string
+		Update bool
+	}
+
+	data := struct {
+		Header    []string
+		Rows      []htmlRow
+		Generated time.Time
+	}{
+		Header:    header,
+		Rows:      make([]htmlRow, 0, len(rows)),
+		Generated: time.Now(),
+	}
+	for i, row := range rows {
+		data.Rows = append(data.Rows, htmlRow{Cells: row, Update: results[i].UpdateAvailable})
+	}
+
+	return htmlTemplate.Execute(w, data)
+}
@@ -2,377 +2,1038 @@ package main
 
 import (
 	"context"
+	"encoding/csv"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
-	"net/http"
+	"io"
+	"log/slog"
 	"os"
+	"os/signal"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
-	"sync"
-
-	"github.com/BurntSushi/toml"
-	"github.com/containers/image/v5/docker/reference"
-	"github.com/google/go-containerregistry/pkg/authn"
-	"github.com/google/go-containerregistry/pkg/name"
-	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
-	"github.com/hashicorp/go-version"
+	"syscall"
+	"time"
+
 	"github.com/hashicorp/nomad/api"
+	"github.com/markpash/nomad-task-updates/pkg/scanner"
 	"github.com/olekukonko/tablewriter"
-	"golang.org/x/sync/errgroup"
 )
 
-type Instance struct {
-	Namespace string
-	Job       string
-	Group     string
-	Task      string
-	Image     reference.NamedTagged
-}
+const (
+	defaultConfigPath = "./config.toml"
+	configPathEnv     = "NOMAD_TASK_UPDATES_CONFIG"
+
+	formatTable    = "table"
+	formatJSON     = "json"
+	formatCSV      = "csv"
+	formatHTML     = "html"
+	formatMarkdown = "markdown"
+
+	groupByJob = "job"
+
+	logFormatText = "text"
+	logFormatJSON = "json"
 
-type WatchedImage struct {
-	Name    string       `toml:"name"`
-	Include []TOMLRegexp `toml:"include"`
-	Exclude []TOMLRegexp `toml:"exclude"`
+	colorAuto   = "auto"
+	colorAlways = "always"
+	colorNever  = "never"
+
+	defaultMetricsInterval = 5 * time.Minute
+)
+
+type options struct {
+	configPaths stringsFlag
+	format      string
+	groupBy     string
+	color       string
+	exitCode    bool
+	failOnError bool
+	onlyMajor   bool
+	onlyMinor   bool
+	onlyPatch   bool
+	// updateType is set from -only-major, -only-minor or -only-patch.
+	updateType      scanner.UpdateType
+	showSkipped     bool
+	updatesOnly     bool
+	showCounts      bool
+	showDigest      bool
+	showAge         bool
+	sortStale       bool
+	diff            string
+	compareDeployed bool
+	reportUnused    bool
+	quiet           bool
+	top             int
+	reportUnwatched bool
+	maxConcurrency  int
+	server          string
+	source          string
+	namespaces      stringsFlag
+	jobs            stringsFlag
+	statuses        stringsFlag
+	since           dateFlag
+	image           string
+	include         regexpsFlag
+	exclude         regexpsFlag
+	sort            string
+	noSort          bool
+	metricsAddr     string
+	interval        time.Duration
+	verbose         bool
+	logLevel        slog.Level
+	logFormat       string
+	apply           bool
+	plan            bool
+	dryRun          bool
 }
 
-type Config struct {
-	Server     string         `toml:"server"`
-	Namespaces []string       `toml:"namespaces"`
-	Images     []WatchedImage `toml:"images"`
+// stringsFlag is a repeatable flag collecting non-empty values.
+type stringsFlag []string
+
+func (sf *stringsFlag) String() string {
+	return strings.Join(*sf, ",")
 }
 
-type TOMLRegexp struct {
-	Regexp *regexp.Regexp
+func (sf *stringsFlag) Set(value string) error {
+	if value == "" {
+		return errors.New("value must not be empty")
+	}
+	*sf = append(*sf, value)
+	return nil
 }
 
-func (tr *TOMLRegexp) UnmarshalTOML(data interface{}) error {
-	rexString, ok := data.(string)
-	if !ok {
-		return errors.New("value must be a string")
+// regexpsFlag is a repeatable flag collecting regular expressions.
+type regexpsFlag []scanner.TOMLRegexp
+
+func (rf *regexpsFlag) String() string {
+	patterns := make([]string, 0, len(*rf))
+	for _, r := range *rf {
+		patterns = append(patterns, r.Regexp.String())
 	}
+	return strings.Join(patterns, ",")
+}
 
-	rex, err := regexp.Compile(rexString)
+func (rf *regexpsFlag) Set(value string) error {
+	r, err := regexp.Compile(value)
 	if err != nil {
 		return err
 	}
+	*rf = append(*rf, scanner.TOMLRegexp{Regexp: r})
+	return nil
+}
 
-	tr.Regexp = rex
+// dateFlag is a flag.Value parsing a date like 2024-01-01, in UTC.
+type dateFlag time.Time
 
+func (df *dateFlag) String() string {
+	if df == nil || time.Time(*df).IsZero() {
+		return ""
+	}
+	return time.Time(*df).Format(time.DateOnly)
+}
+
+func (df *dateFlag) Set(value string) error {
+	t, err := time.Parse(time.DateOnly, value)
+	if err != nil {
+		return err
+	}
+	*df = dateFlag(t)
 	return nil
 }
 
-func parseConfigFile(path string) (Config, error) {
-	var conf Config
-	if _, err := toml.DecodeFile(path, &conf); err != nil {
-		return Config{}, err
+// errIncompleteScan is returned by run with -fail-on-error when the tags of
+// some images couldn't be listed. The images are reported separately.
+var errIncompleteScan = errors.New("the tags of some images couldn't be listed")
+
+// errUpdatesAvailable is returned by run when -exit-code is set and at least
+// one task has an update available. It makes the process exit with status 2;
+// status 1 stays reserved for actual errors.
+var errUpdatesAvailable = errors.New("updates available")
+
+func parseFlags(command string, args []string) (options, error) {
+	var opts options
+
+	set := flag.NewFlagSet("nomad-task-updates "+command, flag.ContinueOnError)
+	set.Usage = func() {
+		fmt.Fprintf(set.Output(), "Usage: nomad-task-updates [scan|apply|version] [flags]\n\nFlags of %s:\n", command)
+		set.PrintDefaults()
+	}
+	set.Var(&opts.configPaths, "config", "path to the config file, - for stdin, may be repeated to merge several files (default $"+configPathEnv+" or "+defaultConfigPath+")")
+	set.StringVar(&opts.format, "format", formatTable, "output format: table, json, csv, html or markdown")
+	set.StringVar(&opts.groupBy, "group-by", "", "with -format table, render a table per job: job")
+	set.StringVar(&opts.color, "color", colorAuto, "color the table rows by whether an update is available: auto, always or never (auto disables color when $NO_COLOR is set or stdout isn't a terminal)")
+	set.BoolVar(&opts.exitCode, "exit-code", false, "exit with status 2 when updates are available (status 1 means an error occurred)")
+	set.BoolVar(&opts.failOnError, "fail-on-error", false, "exit with status 1 when the tags of any image couldn't be listed, after showing the other results, and don't -apply anything (by default such images are skipped)")
+	set.BoolVar(&opts.showSkipped, "show-skipped", false, "show how many tags were skipped because they aren't versions")
+	set.BoolVar(&opts.showCounts, "show-counts", false, "show how many allocations run each task's image")
+	set.BoolVar(&opts.showDigest, "show-digest", false, "resolve and show the manifest digest of each latest tag")
+	set.BoolVar(&opts.showAge, "show-age", false, "show how long before the latest image each outdated task's image was built; costs two extra registry requests per outdated image (sets imageAge in the config)")
+	set.StringVar(&opts.diff, "diff", "", "print what changed since the previous run saved its results to this JSON state file: new updates, updated, added and removed tasks; the first run only saves them")
+	set.BoolVar(&opts.sortStale, "sort-stale", false, "list the most outdated tasks first, by age when known and then by the number of newer versions")
+	set.Var(&opts.since, "since", "only report updates whose latest image was created on or after this date, e.g. 2024-01-01; costs an extra registry request per latest tag (overrides since in the config)")
+	set.BoolVar(&opts.onlyMajor, "only-major", false, "only report tasks with a major update available")
+	set.BoolVar(&opts.onlyMinor, "only-minor", false, "only report tasks with a minor update available")
+	set.BoolVar(&opts.onlyPatch, "only-patch", false, "only report tasks with a patch update available")
+	set.IntVar(&opts.top, "top", 0, "instead of the tasks, list the N newest versions of each watched image")
+	set.BoolVar(&opts.quiet, "quiet", false, "don't print the scanned=N updates=N errors=N summary line on stderr")
+	set.BoolVar(&opts.reportUnused, "report-unused", false, "list the configured images no task runs on stderr after the results")
+	set.BoolVar(&opts.reportUnwatched, "report-unwatched", false, "list the images tasks run that aren't watched on stderr after the results, with the number of tasks running each")
+	set.BoolVar(&opts.updatesOnly, "updates-only", false, "only show tasks with an update available")
+	set.StringVar(&opts.server, "server", "", "address of the Nomad server (overrides $NOMAD_ADDR and server in the config)")
+	set.IntVar(&opts.maxConcurrency, "max-concurrency", 0, "maximum number of concurrent Nomad allocation lookups (overrides maxConcurrency in the config)")
+	set.BoolVar(&opts.compareDeployed, "compare-deployed", false, "with -source jobs, compare the images the allocations run rather than the job specs, showing a SpecImage column for tasks whose spec differs (sets compareDeployed in the config)")
+	set.StringVar(&opts.source, "source", "", "where to read task images from: allocs or jobs (overrides source in the config)")
+	set.Var(&opts.namespaces, "namespace", "namespace to scan, may be repeated (overrides namespaces in the config)")
+	set.Var(&opts.jobs, "job", "job ID or glob pattern to scan, negated with a leading !, may be repeated (overrides jobs in the config)")
+	set.Var(&opts.statuses, "status", "client status of the allocations to scan with -source allocs, may be repeated (overrides allocStatuses in the config, default running)")
+	set.StringVar(&opts.image, "image", "", "check only this image, with none of the config's image settings (no config file is needed)")
+	set.Var(&opts.include, "include", "with -image, only consider tags matching this regular expression, may be repeated")
+	set.Var(&opts.exclude, "exclude", "with -image, ignore tags matching this regular expression, may be repeated")
+	set.StringVar(&opts.sort, "sort", "", "comma separated columns to sort by, each optionally followed by :asc or :desc, e.g. namespace:asc,image (overrides sort in the config)")
+	set.BoolVar(&opts.noSort, "no-sort", false, "keep the order Nomad returned the tasks in, which can differ between runs (sets noSort in the config)")
+	set.StringVar(&opts.metricsAddr, "metrics-addr", "", "serve Prometheus metrics on this address, rescanning every -interval")
+	if command == commandScan {
+		set.BoolVar(&opts.apply, "apply", false, "same as the apply command")
+		set.BoolVar(&opts.plan, "plan", false, "print the changes apply would make to each job, with the job's modify index, without registering anything")
+	}
+	set.BoolVar(&opts.dryRun, "dry-run", true, "with apply, only print the planned changes")
+	set.BoolVar(&opts.verbose, "verbose", false, "shorthand for -log-level debug")
+	set.TextVar(&opts.logLevel, "log-level", slog.LevelWarn, "log level: error, warn, info or debug")
+	set.StringVar(&opts.logFormat, "log-format", logFormatText, "log format: text or json")
+	set.DurationVar(&opts.interval, "interval", 0, "rescan and re-render the output at this interval instead of exiting after one scan (default 5m with -metrics-addr)")
+	if err := set.Parse(args); err != nil {
+		return options{}, err
+	}
+
+	if command == commandApply {
+		opts.apply = true
+	}
+
+	switch opts.format {
+	case formatTable, formatJSON, formatCSV, formatHTML, formatMarkdown:
+	default:
+		return options{}, fmt.Errorf("unknown output format %q", opts.format)
+	}
+
+	switch opts.groupBy {
+	case "", groupByJob:
+	default:
+		return options{}, fmt.Errorf("unknown grouping %q", opts.groupBy)
 	}
 
-	for i, image := range conf.Images {
-		normName, err := reference.ParseNormalizedNamed(image.Name)
-		if err != nil {
-			return Config{}, err
+	switch opts.color {
+	case colorAuto, colorAlways, colorNever:
+	default:
+		return options{}, fmt.Errorf("unknown color mode %q", opts.color)
+	}
+
+	switch opts.source {
+	case "", scanner.SourceAllocs, scanner.SourceJobs:
+	default:
+		return options{}, fmt.Errorf("unknown source %q", opts.source)
+	}
+
+	switch opts.logFormat {
+	case logFormatText, logFormatJSON:
+	default:
+		return options{}, fmt.Errorf("unknown log format %q", opts.logFormat)
+	}
+
+	if opts.verbose {
+		opts.logLevel = slog.LevelDebug
+	}
+
+	for _, only := range []struct {
+		set        bool
+		updateType scanner.UpdateType
+	}{
+		{opts.onlyMajor, scanner.UpdateMajor},
+		{opts.onlyMinor, scanner.UpdateMinor},
+		{opts.onlyPatch, scanner.UpdatePatch},
+	} {
+		if !only.set {
+			continue
+		}
+		if opts.updateType != "" {
+			return options{}, errors.New("-only-major, -only-minor and -only-patch are mutually exclusive")
 		}
+		opts.updateType = only.updateType
+	}
+
+	if opts.noSort && opts.sort != "" {
+		return options{}, errors.New("-sort and -no-sort are mutually exclusive")
+	}
+
+	if opts.plan && opts.apply {
+		return options{}, errors.New("-plan and -apply are mutually exclusive")
+	}
+
+	if opts.top < 0 {
+		return options{}, errors.New("-top must not be negative")
+	}
+	if opts.top > 0 && (opts.plan || opts.apply) {
+		return options{}, errors.New("-top can't be combined with -plan or -apply")
+	}
+
+	if opts.interval < 0 {
+		return options{}, errors.New("-interval must not be negative")
+	}
+	if opts.diff != "" && (opts.top > 0 || opts.plan || opts.apply || opts.interval > 0 || opts.metricsAddr != "") {
+		return options{}, errors.New("-diff can't be combined with -top, -plan, -apply, -interval or -metrics-addr")
+	}
+
+	if opts.image == "" && (len(opts.include) > 0 || len(opts.exclude) > 0) {
+		return options{}, errors.New("-include and -exclude require -image")
+	}
 
-		conf.Images[i].Name = normName.Name()
+	// An ad hoc -image check only reads a config file if one is given.
+	if len(opts.configPaths) == 0 {
+		configPath := os.Getenv(configPathEnv)
+		if configPath == "" && opts.image == "" {
+			configPath = defaultConfigPath
+		}
+		if configPath != "" {
+			opts.configPaths = stringsFlag{configPath}
+		}
 	}
 
-	return conf, nil
+	return opts, nil
 }
 
+// Commands of the tool. Without a command, the arguments are those of scan.
+const (
+	commandScan    = "scan"
+	commandApply   = "apply"
+	commandVersion = "version"
+)
+
 func main() {
-	if err := run(); err != nil {
+	if err := run(os.Args[1:]); errors.Is(err, flag.ErrHelp) {
+		return
+	} else if errors.Is(err, errUpdatesAvailable) {
+		os.Exit(2)
+	} else if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
 }
 
-func run() error {
-	conf, err := parseConfigFile("./config.toml")
+func run(args []string) error {
+	command := commandScan
+	if len(args) > 0 && (args[0] == "-version" || args[0] == "--version") {
+		command, args = commandVersion, args[1:]
+	} else if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	switch command {
+	case commandScan, commandApply:
+		return runScan(command, args)
+	case commandVersion:
+		return printVersion(os.Stdout)
+	default:
+		return fmt.Errorf("unknown command %q, expected scan, apply or version", command)
+	}
+}
+
+// watchOnlyImage returns the config watching only the image of -image, with
+// none of the config's image settings: its images, matchImages, registry
+// catalogs and defaults are all dropped.
+func watchOnlyImage(conf scanner.Config, opts options) scanner.Config {
+	conf.Images = []scanner.WatchedImage{{
+		Name:    opts.image,
+		Include: opts.include,
+		Exclude: opts.exclude,
+	}}
+	conf.MatchImages = scanner.MatchImages{}
+	conf.Defaults = scanner.Defaults{}
+
+	registries := make(map[string]scanner.RegistryConfig, len(conf.Registries))
+	for host, registry := range conf.Registries {
+		registry.Catalog = nil
+		registries[host] = registry
+	}
+	conf.Registries = registries
+
+	return conf
+}
+
+// runScan scans once, or repeatedly in watch and metrics modes, and renders
+// or applies the results.
+func runScan(command string, args []string) error {
+	opts, err := parseFlags(command, args)
 	if err != nil {
 		return err
 	}
 
-	nomadClient, err := api.NewClient(api.DefaultConfig().ClientConfig("", conf.Server, false))
+	logger := newLogger(opts)
+	slog.SetDefault(logger)
+
+	conf, err := scanner.ParseConfigFiles(opts.configPaths...)
 	if err != nil {
 		return err
 	}
 
-	parsedImageTags, err := getImageVersionMapping(conf.Images)
+	conf.Logger = logger
+
+	// Like the Nomad CLI, $NOMAD_ADDR takes precedence over the config.
+	if opts.server != "" {
+		conf.Server = opts.server
+	} else if addr := os.Getenv("NOMAD_ADDR"); addr != "" {
+		conf.Server = addr
+	}
+	if opts.maxConcurrency > 0 {
+		conf.MaxConcurrency = opts.maxConcurrency
+	}
+	if opts.source != "" {
+		conf.Source = opts.source
+	}
+	if len(opts.namespaces) > 0 {
+		conf.Namespaces = opts.namespaces
+	}
+	if len(opts.jobs) > 0 {
+		conf.Jobs = opts.jobs
+	}
+	if len(opts.statuses) > 0 {
+		conf.AllocStatuses = opts.statuses
+	}
+	if opts.sort != "" {
+		conf.Sort = opts.sort
+	}
+	if opts.noSort {
+		conf.NoSort = true
+	}
+	if opts.image != "" {
+		conf = watchOnlyImage(conf, opts)
+	}
+	if opts.showDigest {
+		conf.ResolveDigests = true
+	}
+	if opts.compareDeployed {
+		conf.CompareDeployed = true
+	}
+	if opts.showAge {
+		conf.ImageAge = true
+	}
+	if since := time.Time(opts.since); !since.IsZero() {
+		conf.Since = since
+	}
+
+	nomadClient, err := newNomadClient(conf)
 	if err != nil {
 		return err
 	}
 
-	instances, err := getAllInstances(nomadClient, conf.Namespaces)
+	s, err := scanner.New(nomadClient, conf)
 	if err != nil {
 		return err
 	}
 
-	table := tablewriter.NewWriter(os.Stdout)
-	table.SetHeader([]string{"Namespace", "Job", "Group", "Task", "Image", "Latest", "Current", "UpdateAvailable"})
+	a := &app{
+		opts:      opts,
+		scanner:   s,
+		notifiers: newNotifiers(conf),
+	}
 
-	for _, instance := range instances {
-		versions, ok := parsedImageTags[instance.Image.Name()]
-		if !ok {
-			continue
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if opts.metricsAddr != "" {
+		interval := opts.interval
+		if interval == 0 {
+			interval = defaultMetricsInterval
 		}
+		return serveMetrics(ctx, a, interval)
+	}
 
-		latest := getNewestVersion(versions)
-		current, err := version.NewVersion(instance.Image.Tag())
-		if err != nil {
-			return err
+	if opts.interval > 0 {
+		return watch(ctx, a)
+	}
+
+	results, err := a.scan(ctx)
+	var partial *scanner.PartialError
+	if err != nil && !errors.As(err, &partial) {
+		return err
+	}
+	if !opts.quiet {
+		defer renderSummary(os.Stderr, results, partial)
+	}
+	if partial != nil {
+		defer renderErrors(os.Stderr, opts, partial)
+	}
+	if unused := s.UnusedImages(); opts.reportUnused && len(unused) > 0 {
+		defer renderUnused(os.Stderr, opts, unused)
+	}
+	if unwatched := s.UnwatchedImages(); opts.reportUnwatched && len(unwatched) > 0 {
+		defer renderUnwatched(os.Stderr, opts, unwatched)
+	}
+
+	// Strict runs still show what could be checked, but don't change any
+	// jobs based on an incomplete scan.
+	if opts.failOnError && partial != nil && opts.apply {
+		return errIncompleteScan
+	}
+
+	switch {
+	case opts.top > 0:
+		err = renderVersions(os.Stdout, opts, s.NewestVersions(opts.top))
+	case opts.diff != "":
+		err = diffScans(os.Stdout, opts, opts.diff, results, partial)
+	case opts.plan:
+		err = planUpdates(os.Stdout, nomadClient, results)
+	case opts.apply:
+		err = applyUpdates(os.Stdout, nomadClient, results, opts.dryRun)
+	default:
+		err = render(os.Stdout, opts, results)
+		if err == nil && opts.exitCode && hasUpdates(results) {
+			err = errUpdatesAvailable
 		}
-		updateAvailable := latest.GreaterThan(current)
+	}
 
-		table.Append([]string{
-			instance.Namespace,
-			instance.Job,
-			instance.Group,
-			instance.Task,
-			instance.Image.Name(),
-			latest.String(),
-			current.String(),
-			strconv.FormatBool(updateAvailable),
-		})
+	// Errors take precedence over the -exit-code status.
+	if opts.failOnError && partial != nil && (err == nil || errors.Is(err, errUpdatesAvailable)) {
+		return errIncompleteScan
 	}
-	table.Render()
 
-	return nil
+	return err
 }
 
-func getImageTagMapping(ctx context.Context, images []WatchedImage) (map[string][]string, error) {
-	g, ctx := errgroup.WithContext(ctx)
-	var mu sync.Mutex
-
-	imageTags := make(map[string][]string)
-	for _, watch := range images {
-		watch := watch
-		g.Go(func() error {
-			tags, err := getTags(ctx, watch)
-			if err != nil {
-				return err
-			}
+// newNomadClient returns a client for the configured server. The ACL token
+// and TLS settings are read from the NOMAD_* environment variables, falling
+// back to the config. The server is reached over HTTPS if TLS is configured
+// or its address says so.
+func newNomadClient(conf scanner.Config) (*api.Client, error) {
+	nomadConf := api.DefaultConfig()
+	if nomadConf.SecretID == "" {
+		nomadConf.SecretID = conf.Token
+	}
 
-			mu.Lock()
-			imageTags[watch.Name] = tags
-			mu.Unlock()
+	tls := nomadConf.TLSConfig
+	if tls.CACert == "" {
+		tls.CACert = conf.TLS.CACert
+	}
+	if tls.ClientCert == "" {
+		tls.ClientCert = conf.TLS.ClientCert
+	}
+	if tls.ClientKey == "" {
+		tls.ClientKey = conf.TLS.ClientKey
+	}
+	if tls.TLSServerName == "" {
+		tls.TLSServerName = conf.TLS.ServerName
+	}
+	if os.Getenv("NOMAD_SKIP_VERIFY") == "" {
+		tls.Insecure = conf.TLS.SkipVerify
+	}
 
-			return nil
-		})
+	scheme := "http"
+	if tls.CACert != "" || tls.CAPath != "" || tls.ClientCert != "" || tls.Insecure {
+		scheme = "https"
 	}
 
-	if err := g.Wait(); err != nil {
-		return nil, err
+	nomadConf.Address = conf.Server
+	if !strings.Contains(conf.Server, "://") {
+		nomadConf.Address = scheme + "://" + conf.Server
 	}
 
-	return imageTags, nil
+	return api.NewClient(nomadConf)
 }
 
-func getImageVersionMapping(images []WatchedImage) (map[string][]*version.Version, error) {
-	imageTags, err := getImageTagMapping(context.Background(), images)
-	if err != nil {
+// app holds what every scan needs, whichever mode the tool runs in.
+type app struct {
+	opts      options
+	scanner   *scanner.Scanner
+	notifiers []notifier
+}
+
+// scan runs a single scan and passes its results on to the notifiers.
+// Notification failures are logged rather than failing the scan. Partial
+// results are returned along with their *scanner.PartialError.
+func (a *app) scan(ctx context.Context) ([]scanner.Result, error) {
+	results, err := a.scanner.Scan(ctx)
+	hits, misses := a.scanner.CacheStats()
+	slog.Debug("scan finished", "cacheHits", hits, "cacheMisses", misses)
+	var partial *scanner.PartialError
+	if err != nil && !errors.As(err, &partial) {
 		return nil, err
 	}
 
-	parsedImageTags := make(map[string][]*version.Version)
-	for imageName, tags := range imageTags {
-		vers := make([]*version.Version, len(tags))
-		for i, tagStr := range tags {
-			ver, err := version.NewVersion(tagStr)
-			if err != nil {
-				return nil, fmt.Errorf("couldn't parse image tag version for %s: %w", imageName, err)
-			}
-			vers[i] = ver
-		}
+	if a.opts.updateType != "" {
+		results = filterUpdateType(results, a.opts.updateType)
+	}
+	if a.opts.sortStale {
+		sortStale(results)
+	}
 
-		parsedImageTags[imageName] = vers
+	for _, n := range a.notifiers {
+		if err := n.notify(ctx, results); err != nil {
+			slog.Error("notification failed", "error", err)
+		}
 	}
 
-	return parsedImageTags, nil
+	return results, err
 }
 
-func getTags(ctx context.Context, watched WatchedImage) ([]string, error) {
-	repo, err := name.NewRepository(watched.Name)
-	if err != nil {
-		return nil, err
+func newLogger(opts options) *slog.Logger {
+	handlerOpts := &slog.HandlerOptions{Level: opts.logLevel}
+	if opts.logFormat == logFormatJSON {
+		return slog.New(slog.NewJSONHandler(os.Stderr, handlerOpts))
 	}
+	return slog.New(slog.NewTextHandler(os.Stderr, handlerOpts))
+}
 
-	scopes := []string{repo.Scope(transport.PullScope)}
-	t, err := transport.NewWithContext(ctx, repo.Registry, authn.Anonymous, http.DefaultTransport, scopes)
-	if err != nil {
-		return nil, err
+func render(w io.Writer, opts options, results []scanner.Result) error {
+	if opts.updatesOnly {
+		results = filterUpdates(results)
+		if len(results) == 0 && opts.format == formatTable {
+			_, err := fmt.Fprintln(w, "All tasks are up to date.")
+			return err
+		}
 	}
-	client := &http.Client{Transport: t}
 
-	path := fmt.Sprintf("v2/%s/tags/list", repo.RepositoryStr())
-	url := fmt.Sprintf("%s://%s/%s", repo.Scheme(), repo.RegistryStr(), path)
-
-	resp, err := client.Get(url)
-	if err != nil {
-		return nil, err
+	switch opts.format {
+	case formatJSON:
+		return renderJSON(w, results)
+	case formatCSV:
+		return renderCSV(w, results, opts)
+	case formatHTML:
+		return renderHTML(w, results, opts)
+	case formatMarkdown:
+		return renderMarkdown(w, results, opts)
+	default:
+		if opts.groupBy == groupByJob {
+			return renderGroupedTable(w, results, opts)
+		}
+		return renderTable(w, results, opts)
 	}
-	defer resp.Body.Close()
+}
 
-	if err := transport.CheckError(resp, http.StatusOK); err != nil {
-		return nil, err
+// renderSummary prints a single line of counts for log scraping, such as
+// "scanned=120 updates=7 errors=2".
+func renderSummary(w io.Writer, results []scanner.Result, partial *scanner.PartialError) error {
+	updates := 0
+	for _, result := range results {
+		if result.UpdateAvailable {
+			updates++
+		}
 	}
 
-	jsonResp := struct {
-		Tags []string `json:"tags"`
-	}{}
-	decoder := json.NewDecoder(resp.Body)
-	if err := decoder.Decode(&jsonResp); err != nil {
-		return nil, err
+	errs := 0
+	if partial != nil {
+		errs = len(partial.Images)
 	}
 
-	return filterTags(jsonResp.Tags, watched.Include, watched.Exclude), nil
+	_, err := fmt.Fprintf(w, "scanned=%d updates=%d errors=%d\n", len(results), updates, errs)
+	return err
 }
 
-func getNewestVersion(versions []*version.Version) *version.Version {
-	var newestVersion *version.Version
-	for i, v := range versions {
-		if i == 0 {
-			newestVersion = v
-			continue
-		}
-
-		if v.GreaterThan(newestVersion) {
-			newestVersion = v
+func hasUpdates(results []scanner.Result) bool {
+	for _, result := range results {
+		if result.UpdateAvailable {
+			return true
 		}
 	}
-
-	return newestVersion
+	return false
 }
 
-func getInstances(client *api.Client, namespace string) ([]Instance, error) {
-	if namespace == "" {
-		namespace = "*"
+// filterUpdates returns the results with an update available. It never
+// returns nil so that the JSON output is an empty array rather than null.
+func filterUpdates(results []scanner.Result) []scanner.Result {
+	updates := make([]scanner.Result, 0)
+	for _, result := range results {
+		if result.UpdateAvailable {
+			updates = append(updates, result)
+		}
 	}
+	return updates
+}
 
-	opt := api.QueryOptions{
-		Namespace:  namespace,
-		AllowStale: false,
+// filterUpdateType returns the results with an update of the given type
+// available, for -only-major, -only-minor and -only-patch.
+func filterUpdateType(results []scanner.Result, updateType scanner.UpdateType) []scanner.Result {
+	filtered := make([]scanner.Result, 0)
+	for _, result := range results {
+		if result.UpdateType == updateType {
+			filtered = append(filtered, result)
+		}
 	}
+	return filtered
+}
 
-	allocations := client.Allocations()
+// sortStale orders the results from the most to the least outdated: those
+// whose age is known by age, then by how many versions they're behind.
+func sortStale(results []scanner.Result) {
+	sort.SliceStable(results, func(i, j int) bool {
+		ageI, okI := results[i].Age()
+		ageJ, okJ := results[j].Age()
+		if okI != okJ {
+			return okI
+		}
+		if ageI != ageJ {
+			return ageI > ageJ
+		}
+		return results[i].Behind > results[j].Behind
+	})
+}
 
-	alss, _, err := allocations.List(&opt)
-	if err != nil {
-		return nil, err
+// formatAge renders an age in whole days, or hours for images built within
+// a day of each other.
+func formatAge(age time.Duration) string {
+	if age < 24*time.Hour {
+		return fmt.Sprintf("%dh", int(age.Hours()))
 	}
+	return fmt.Sprintf("%dd", int(age.Hours()/24))
+}
 
-	instances := make([]Instance, 0)
-	for _, als := range alss {
-		alloc, _, err := allocations.Info(als.ID, &opt)
-		if err != nil {
-			return nil, err
+// tableRows returns the header and rows shared by the table and CSV formats.
+func tableRows(results []scanner.Result, opts options) ([]string, [][]string) {
+	showDigestChanged, showAge, showSpecImage, showWarnings := false, false, false, false
+	for _, result := range results {
+		if result.DigestChanged != nil {
+			showDigestChanged = true
 		}
+		if _, ok := result.Age(); ok {
+			showAge = true
+		}
+		if result.SpecImage != "" {
+			showSpecImage = true
+		}
+		if len(result.Warnings) > 0 {
+			showWarnings = true
+		}
+	}
 
-		tg := alloc.GetTaskGroup()
+	header := []string{"Namespace", "Job", "Group", "Task", "Image", "Latest", "Current", "UpdateAvailable", "Behind", "UpdateType"}
+	if showAge {
+		header = append(header, "Age")
+	}
+	if opts.showSkipped {
+		header = append(header, "SkippedTags")
+	}
+	if opts.showCounts {
+		header = append(header, "Count")
+	}
+	if showDigestChanged {
+		header = append(header, "DigestChanged")
+	}
+	if opts.showDigest {
+		header = append(header, "LatestDigest")
+	}
+	if showSpecImage {
+		header = append(header, "SpecImage")
+	}
+	if showWarnings {
+		header = append(header, "Warnings")
+	}
 
-		jobName := als.JobID
-		groupName := tg.Name
+	rows := make([][]string, 0, len(results))
+	for _, result := range results {
+		current := result.Current
+		if result.Pinned {
+			current = "digest-pinned " + shortDigest(result.Current)
+		}
 
-		for _, task := range tg.Tasks {
-			if task.Driver != "docker" {
-				continue
+		row := []string{
+			result.Namespace,
+			result.Job,
+			result.Group,
+			result.Task,
+			result.Image,
+			result.Latest,
+			current,
+			strconv.FormatBool(result.UpdateAvailable),
+			strconv.Itoa(result.Behind),
+			string(result.UpdateType),
+		}
+		if showAge {
+			age := ""
+			if d, ok := result.Age(); ok {
+				age = formatAge(d)
 			}
-
-			imageStr := task.Config["image"].(string)
-			if strings.HasPrefix(imageStr, "$") {
-				continue
+			row = append(row, age)
+		}
+		if opts.showSkipped {
+			row = append(row, strconv.Itoa(result.SkippedTags))
+		}
+		if opts.showCounts {
+			row = append(row, strconv.Itoa(result.Count))
+		}
+		if showDigestChanged {
+			digestChanged := ""
+			if result.DigestChanged != nil {
+				digestChanged = strconv.FormatBool(*result.DigestChanged)
 			}
-
-			image, err := reference.ParseDockerRef(imageStr)
-			if err != nil {
-				continue
+			row = append(row, digestChanged)
+		}
+		if opts.showDigest {
+			latestDigest := result.LatestDigest
+			if latestDigest == "" {
+				latestDigest = "-"
 			}
-
-			instances = append(instances, Instance{
-				Namespace: als.Namespace,
-				Job:       jobName,
-				Group:     *groupName,
-				Task:      task.Name,
-				Image:     image.(reference.NamedTagged),
-			})
+			row = append(row, latestDigest)
 		}
+		if showSpecImage {
+			row = append(row, result.SpecImage)
+		}
+		if showWarnings {
+			row = append(row, strings.Join(result.Warnings, "; "))
+		}
+		rows = append(rows, row)
 	}
 
-	return instances, nil
+	return header, rows
 }
 
-func getAllInstances(client *api.Client, namespaces []string) ([]Instance, error) {
-	var allInstances []Instance
-	for _, namespace := range namespaces {
-		instances, err := getInstances(client, namespace)
-		if err != nil {
-			return nil, err
-		}
-		allInstances = append(allInstances, instances...)
+// shortDigest abbreviates a digest such as sha256:abc... to its first 12
+// hex characters, like docker does.
+func shortDigest(digest string) string {
+	_, hex, ok := strings.Cut(digest, ":")
+	if !ok || len(hex) < 12 {
+		return digest
 	}
-	sortInstances(allInstances)
-	return allInstances, nil
+	return hex[:12]
+}
+
+func renderTable(w io.Writer, results []scanner.Result, opts options) error {
+	header, rows := tableRows(results, opts)
+	writeTable(w, header, rows, results, useColor(w, opts.color))
+	return nil
 }
 
-func sortInstances(instances []Instance) {
-	less := func(i, j int) bool {
-		if instances[i].Namespace != instances[j].Namespace {
-			return instances[i].Namespace > instances[j].Namespace
+// renderGroupedTable renders a table per job for -group-by job, leaving out
+// the namespace and job columns. Jobs are listed in the order of the results.
+func renderGroupedTable(w io.Writer, results []scanner.Result, opts options) error {
+	header, rows := tableRows(results, opts)
+	color := useColor(w, opts.color)
+
+	var jobs []string
+	jobRows := make(map[string][]int)
+	for i, result := range results {
+		key := result.Namespace + "/" + result.Job
+		if _, ok := jobRows[key]; !ok {
+			jobs = append(jobs, key)
 		}
+		jobRows[key] = append(jobRows[key], i)
+	}
 
-		if instances[i].Job != instances[j].Job {
-			return instances[i].Job > instances[j].Job
+	for n, job := range jobs {
+		if n > 0 {
+			fmt.Fprintln(w)
 		}
+		fmt.Fprintf(w, "Job %s\n", job)
 
-		if instances[i].Group != instances[j].Group {
-			return instances[i].Group > instances[j].Group
+		groupRows := make([][]string, 0, len(jobRows[job]))
+		groupResults := make([]scanner.Result, 0, len(jobRows[job]))
+		for _, i := range jobRows[job] {
+			groupRows = append(groupRows, rows[i][2:])
+			groupResults = append(groupResults, results[i])
 		}
+		writeTable(w, header[2:], groupRows, groupResults, color)
+	}
+
+	return nil
+}
+
+// writeTable renders the rows of the results, colored by whether an update is
+// available if color is set.
+func writeTable(w io.Writer, header []string, rows [][]string, results []scanner.Result, color bool) {
+	table := tablewriter.NewWriter(w)
+	table.SetHeader(header)
+	if color {
+		for i, row := range rows {
+			color := tablewriter.Colors{tablewriter.FgGreenColor}
+			if results[i].UpdateAvailable {
+				color = tablewriter.Colors{tablewriter.FgRedColor}
+			}
 
-		if instances[i].Task != instances[j].Task {
-			return instances[i].Task > instances[j].Task
+			colors := make([]tablewriter.Colors, len(row))
+			for j := range colors {
+				colors[j] = color
+			}
+			table.Rich(row, colors)
 		}
+	} else {
+		table.AppendBulk(rows)
+	}
+	table.Render()
+}
 
+// useColor reports whether output to w should be colored in the given mode.
+// In auto mode it is only colored for terminals and if $NO_COLOR isn't set.
+func useColor(w io.Writer, mode string) bool {
+	switch mode {
+	case colorAlways:
+		return true
+	case colorNever:
 		return false
 	}
 
-	sort.Slice(instances, less)
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
 }
 
-func isIncluded(s string, includes []TOMLRegexp) bool {
-	if len(includes) == 0 {
-		return true
+func renderCSV(w io.Writer, results []scanner.Result, opts options) error {
+	header, rows := tableRows(results, opts)
+
+	writer := csv.NewWriter(w)
+	if err := writer.Write(header); err != nil {
+		return err
 	}
-	for _, include := range includes {
-		if include.Regexp.MatchString(s) {
-			return true
+	return writer.WriteAll(rows)
+}
+
+// renderMarkdown writes the table rows as a GitHub flavored Markdown table,
+// in bold for the tasks with an update available.
+func renderMarkdown(w io.Writer, results []scanner.Result, opts options) error {
+	header, rows := tableRows(results, opts)
+
+	writeRow := func(cells []string) error {
+		_, err := fmt.Fprintf(w, "| %s |\n", strings.Join(cells, " | "))
+		return err
+	}
+
+	separator := make([]string, len(header))
+	for i := range separator {
+		separator[i] = "---"
+	}
+	if err := writeRow(header); err != nil {
+		return err
+	}
+	if err := writeRow(separator); err != nil {
+		return err
+	}
+
+	for i, row := range rows {
+		cells := make([]string, len(row))
+		for j, cell := range row {
+			cell = strings.ReplaceAll(cell, "|", `\|`)
+			if results[i].UpdateAvailable && cell != "" {
+				cell = "**" + cell + "**"
+			}
+			cells[j] = cell
+		}
+		if err := writeRow(cells); err != nil {
+			return err
 		}
 	}
-	return false
+
+	return nil
 }
 
-func isExcluded(s string, excludes []TOMLRegexp) bool {
-	if len(excludes) == 0 {
-		return false
+// renderErrors lists the images whose tags couldn't be listed, as JSON in the
+// JSON format and as a table otherwise.
+func renderErrors(w io.Writer, opts options, partial *scanner.PartialError) error {
+	type imageError struct {
+		Image string `json:"image"`
+		Error string `json:"error"`
 	}
-	for _, exclude := range excludes {
-		if exclude.Regexp.MatchString(s) {
-			return true
-		}
+
+	errs := make([]imageError, 0, len(partial.Images))
+	for _, imageErr := range partial.Images {
+		errs = append(errs, imageError{Image: imageErr.Image, Error: imageErr.Err.Error()})
 	}
-	return false
+
+	if opts.format == formatJSON {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(map[string][]imageError{"errors": errs})
+	}
+
+	fmt.Fprintln(w, "Failed images:")
+	table := tablewriter.NewWriter(w)
+	table.SetHeader([]string{"Image", "Error"})
+	for _, err := range errs {
+		table.Append([]string{err.Image, err.Error})
+	}
+	table.Render()
+
+	return nil
 }
 
-func filterTags(tags []string, include, exclude []TOMLRegexp) []string {
-	filtered := make([]string, 0)
-	for _, tag := range tags {
-		if !isIncluded(tag, include) {
-			continue
-		} else if isExcluded(tag, exclude) {
-			continue
+// renderVersions lists the newest versions of each image for -top, one row
+// per image.
+func renderVersions(w io.Writer, opts options, images []scanner.ImageVersions) error {
+	switch opts.format {
+	case formatJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(images)
+	case formatCSV:
+		writer := csv.NewWriter(w)
+		if err := writer.Write([]string{"Image", "Versions"}); err != nil {
+			return err
+		}
+		for _, image := range images {
+			if err := writer.Write([]string{image.Image, strings.Join(image.Versions, " ")}); err != nil {
+				return err
+			}
 		}
-		filtered = append(filtered, tag)
+		writer.Flush()
+		return writer.Error()
+	default:
+		table := tablewriter.NewWriter(w)
+		table.SetHeader([]string{"Image", "Versions"})
+		for _, image := range images {
+			table.Append([]string{image.Image, strings.Join(image.Versions, ", ")})
+		}
+		table.Render()
+		return nil
 	}
-	return filtered
+}
+
+// renderUnused lists the configured images no task runs, as JSON in the JSON
+// format and as a table otherwise.
+func renderUnused(w io.Writer, opts options, images []string) error {
+	if opts.format == formatJSON {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(map[string][]string{"unused": images})
+	}
+
+	fmt.Fprintln(w, "Unused images:")
+	table := tablewriter.NewWriter(w)
+	table.SetHeader([]string{"Image"})
+	for _, image := range images {
+		table.Append([]string{image})
+	}
+	table.Render()
+
+	return nil
+}
+
+// renderUnwatched lists the images tasks run that aren't watched, as JSON in
+// the JSON format and as a table otherwise.
+func renderUnwatched(w io.Writer, opts options, images []scanner.UnwatchedImage) error {
+	if opts.format == formatJSON {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(map[string][]scanner.UnwatchedImage{"unwatched": images})
+	}
+
+	fmt.Fprintln(w, "Unwatched images:")
+	table := tablewriter.NewWriter(w)
+	table.SetHeader([]string{"Image", "Tasks"})
+	for _, image := range images {
+		table.Append([]string{image.Image, strconv.Itoa(image.Tasks)})
+	}
+	table.Render()
+
+	return nil
+}
+
+func renderJSON(w io.Writer, results []scanner.Result) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(results)
 }
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/markpash/nomad-task-updates/pkg/scanner"
+)
+
+func TestWatchOnlyImage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	config := `
+[[images]]
+name = "postgres"
+
+[matchImages]
+include = [ "^registry.internal/" ]
+
+[defaults]
+exclude = [ "-rc" ]
+
+[registries."registry.internal"]
+tagsPath = "api/%s/tags"
+
+[registries."registry.internal".catalog]
+include = [ "^team/" ]
+`
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	opts, err := parseFlags(commandScan, []string{"-config", path, "-image", "redis", "-include", `^7\.`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf, err := scanner.ParseConfigFiles(opts.configPaths...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conf = watchOnlyImage(conf, opts)
+	if len(conf.Images) != 1 || conf.Images[0].Name != "redis" || len(conf.Images[0].Include) != 1 {
+		t.Errorf("Images = %+v, want only redis with the -include pattern", conf.Images)
+	}
+	if len(conf.MatchImages.Include) != 0 {
+		t.Errorf("MatchImages = %+v, want none", conf.MatchImages)
+	}
+	if len(conf.Defaults.Exclude) != 0 {
+		t.Errorf("Defaults = %+v, want none", conf.Defaults)
+	}
+	registry := conf.Registries["registry.internal"]
+	if registry.Catalog != nil {
+		t.Errorf("catalog = %+v, want none", registry.Catalog)
+	}
+	if registry.TagsPath != "api/%s/tags" {
+		t.Errorf("tagsPath = %q, want the config's other registry settings kept", registry.TagsPath)
+	}
+}
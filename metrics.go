@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/markpash/nomad-task-updates/pkg/scanner"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+type metrics struct {
+	updateAvailable *prometheus.GaugeVec
+	scanErrors      prometheus.Counter
+	imageErrors     prometheus.Gauge
+}
+
+func newMetrics(reg prometheus.Registerer) *metrics {
+	m := &metrics{
+		updateAvailable: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "nomad_task_update_available",
+			Help: "Whether a newer version of the task's image is available (1) or not (0).",
+		}, []string{"namespace", "job", "group", "task", "image"}),
+		scanErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "nomad_task_update_scan_errors_total",
+			Help: "Number of scans that failed.",
+		}),
+		imageErrors: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "nomad_task_update_image_errors",
+			Help: "Number of watched images whose tags couldn't be listed in the last scan.",
+		}),
+	}
+
+	reg.MustRegister(m.updateAvailable, m.scanErrors, m.imageErrors)
+
+	return m
+}
+
+// update replaces the gauges with the given results so that tasks which have
+// disappeared since the previous scan stop being reported.
+func (m *metrics) update(results []scanner.Result) {
+	m.updateAvailable.Reset()
+	for _, result := range results {
+		value := 0.0
+		if result.UpdateAvailable {
+			value = 1
+		}
+
+		m.updateAvailable.WithLabelValues(
+			result.Namespace,
+			result.Job,
+			result.Group,
+			result.Task,
+			result.Image,
+		).Set(value)
+	}
+}
+
+// serveMetrics exposes the scan results on -metrics-addr in the Prometheus format,
+// rescanning every interval until ctx is cancelled or the HTTP server fails.
+func serveMetrics(ctx context.Context, a *app, interval time.Duration) error {
+	reg := prometheus.NewRegistry()
+	m := newMetrics(reg)
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	server := &http.Server{Addr: a.opts.metricsAddr, Handler: mux}
+
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		results, err := a.scan(ctx)
+		var partial *scanner.PartialError
+		if ctx.Err() != nil {
+			return server.Shutdown(context.Background())
+		} else if err != nil && !errors.As(err, &partial) {
+			m.scanErrors.Inc()
+			slog.Error("scan failed", "error", err)
+		} else {
+			m.update(results)
+			m.imageErrors.Set(0)
+			if partial != nil {
+				m.imageErrors.Set(float64(len(partial.Images)))
+				for _, imageErr := range partial.Images {
+					slog.Warn("skipped image", "image", imageErr.Image, "error", imageErr.Err)
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return server.Shutdown(context.Background())
+		case err := <-serverErr:
+			return err
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/markpash/nomad-task-updates/pkg/scanner"
+)
+
+const (
+	notifyTimeout = 30 * time.Second
+
+	webhookMaxRetries = 3
+	webhookRetryDelay = time.Second
+)
+
+type notifier interface {
+	notify(ctx context.Context, results []scanner.Result) error
+}
+
+func newNotifiers(conf scanner.Config) []notifier {
+	var notifiers []notifier
+	if conf.Slack.WebhookURL != "" {
+		notifiers = append(notifiers, newSlackNotifier(conf.Slack))
+	}
+	if conf.Webhook.URL != "" {
+		notifiers = append(notifiers, newWebhookNotifier(conf.Webhook))
+	}
+	return notifiers
+}
+
+// slackNotifier posts the updates that weren't available in the previous
+// scan to a Slack incoming webhook, so that watch mode doesn't repeat itself
+// every interval.
+type slackNotifier struct {
+	webhookURL string
+	client     *http.Client
+
+	// notified maps each task with an update available to the latest
+	// version it was reported with.
+	notified map[string]string
+}
+
+func newSlackNotifier(conf scanner.SlackConfig) *slackNotifier {
+	return &slackNotifier{
+		webhookURL: conf.WebhookURL,
+		client:     &http.Client{Timeout: notifyTimeout},
+		notified:   make(map[string]string),
+	}
+}
+
+func (n *slackNotifier) notify(ctx context.Context, results []scanner.Result) error {
+	var fresh []scanner.Result
+	notified := make(map[string]string)
+	for _, result := range results {
+		if !result.UpdateAvailable {
+			continue
+		}
+
+		key := resultKey(result)
+		if n.notified[key] != result.Latest {
+			fresh = append(fresh, result)
+		}
+		notified[key] = result.Latest
+	}
+
+	if len(fresh) == 0 {
+		n.notified = notified
+		return nil
+	}
+
+	var text strings.Builder
+	text.WriteString("New image updates available:\n")
+	for _, result := range fresh {
+		fmt.Fprintf(&text, "• %s/%s/%s (%s): %s → %s\n",
+			result.Namespace, result.Job, result.Task, result.Image, result.Current, result.Latest)
+	}
+
+	body, err := json.Marshal(struct {
+		Text string `json:"text"`
+	}{Text: text.String()})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("slack webhook returned %s", resp.Status)
+	}
+
+	// Only remember what was sent once it was delivered, so failed
+	// notifications are retried after the next scan.
+	n.notified = notified
+
+	return nil
+}
+
+// webhookNotifier posts the full results of every scan as JSON, or only the
+// ones that differ from the previously delivered results with onlyOnChange.
+type webhookNotifier struct {
+	url          string
+	headers      map[string]string
+	onlyOnChange bool
+	client       *http.Client
+
+	lastBody []byte
+}
+
+func newWebhookNotifier(conf scanner.WebhookConfig) *webhookNotifier {
+	timeout := conf.Timeout.Duration
+	if timeout <= 0 {
+		timeout = notifyTimeout
+	}
+
+	return &webhookNotifier{
+		url:          conf.URL,
+		headers:      conf.Headers,
+		onlyOnChange: conf.OnlyOnChange,
+		client:       &http.Client{Timeout: timeout},
+	}
+}
+
+func (n *webhookNotifier) notify(ctx context.Context, results []scanner.Result) error {
+	body, err := json.Marshal(results)
+	if err != nil {
+		return err
+	}
+
+	if n.onlyOnChange && bytes.Equal(body, n.lastBody) {
+		return nil
+	}
+
+	for attempt := 0; ; attempt++ {
+		err = n.post(ctx, body)
+		if err == nil || !errors.Is(err, errServerError) || attempt >= webhookMaxRetries {
+			break
+		}
+
+		timer := time.NewTimer(webhookRetryDelay << attempt)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	n.lastBody = body
+
+	return nil
+}
+
+// errServerError marks webhook responses with a 5xx status, which are worth
+// retrying.
+var errServerError = errors.New("server error")
+
+func (n *webhookNotifier) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range n.headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("webhook returned %s: %w", resp.Status, errServerError)
+	} else if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+
+	return nil
+}
+
+func resultKey(result scanner.Result) string {
+	return strings.Join([]string{result.Namespace, result.Job, result.Group, result.Task, result.Image}, "/")
+}
@@ -0,0 +1,235 @@
+package scanner
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/hashicorp/nomad/api"
+)
+
+// JobUpdate lists the image tag changes to submit for a single job.
+type JobUpdate struct {
+	Namespace string
+	Job       string
+	Tasks     []TaskUpdate
+}
+
+type TaskUpdate struct {
+	Group   string
+	Task    string
+	Image   string
+	FromTag string
+	ToTag   string
+	// ImageKey is the task config key holding the image, "image" if empty.
+	ImageKey string
+}
+
+// PlanUpdates groups the results that have a newer tag available by job, so
+// that a job with several outdated tasks is only submitted once.
+func PlanUpdates(results []Result) []JobUpdate {
+	var updates []JobUpdate
+	jobIndex := make(map[string]int)
+	planned := make(map[string]bool)
+	for _, result := range results {
+		// Tasks pinned by digest only have no tag to rewrite.
+		if !result.UpdateAvailable || result.Pinned || result.LatestTag == result.CurrentTag {
+			continue
+		}
+
+		// Allocations of the same task show up as separate results.
+		taskKey := strings.Join([]string{result.Namespace, result.Job, result.Group, result.Task}, "/")
+		if planned[taskKey] {
+			continue
+		}
+		planned[taskKey] = true
+
+		jobKey := result.Namespace + "/" + result.Job
+		i, ok := jobIndex[jobKey]
+		if !ok {
+			i = len(updates)
+			jobIndex[jobKey] = i
+			updates = append(updates, JobUpdate{
+				Namespace: result.Namespace,
+				Job:       result.Job,
+			})
+		}
+
+		updates[i].Tasks = append(updates[i].Tasks, TaskUpdate{
+			Group:    result.Group,
+			Task:     result.Task,
+			Image:    result.Image,
+			FromTag:  result.CurrentTag,
+			ToTag:    result.LatestTag,
+			ImageKey: result.imageKey,
+		})
+	}
+
+	return updates
+}
+
+// ApplyUpdate rewrites the image tags of the job's tasks and registers the
+// new version of the job. Registration fails if the job was modified after it
+// was read. The tasks that can't be rewritten are left as they are and
+// returned as a combined error after registering the others.
+func ApplyUpdate(client *api.Client, update JobUpdate) error {
+	plan, err := PlanUpdate(client, update)
+	if err != nil {
+		return err
+	}
+
+	errs := make([]error, 0, len(plan.Skipped)+1)
+	if len(plan.Changes) > 0 {
+		errs = append(errs, RegisterPlan(client, plan))
+	}
+	for _, skipped := range plan.Skipped {
+		errs = append(errs, skipped)
+	}
+	return errors.Join(errs...)
+}
+
+// JobPlan is a job with its image tags updated, ready to be registered.
+type JobPlan struct {
+	Job *api.Job
+	// ModifyIndex is the index of the job the plan is based on. Registering
+	// the plan fails if the job has been modified since.
+	ModifyIndex uint64
+	Changes     []ImageChange
+	// Skipped are the tasks whose image couldn't be rewritten, such as
+	// interpolated images or ones changed since the scan.
+	Skipped []SkippedTask
+}
+
+// SkippedTask is a task of a JobPlan whose image is left as it is.
+type SkippedTask struct {
+	Group string
+	Task  string
+	Err   error
+}
+
+func (s SkippedTask) Error() string {
+	return fmt.Sprintf("task %s/%s: %v", s.Group, s.Task, s.Err)
+}
+
+func (s SkippedTask) Unwrap() error {
+	return s.Err
+}
+
+// ImageChange describes the image of a task before and after an update, as
+// written in the job spec.
+type ImageChange struct {
+	Group string
+	Task  string
+	From  string
+	To    string
+}
+
+// PlanUpdate reads the job of update and rewrites the images of its tasks,
+// without registering it. Tasks whose image can't be rewritten are skipped
+// and listed in the plan's Skipped.
+func PlanUpdate(client *api.Client, update JobUpdate) (*JobPlan, error) {
+	job, _, err := client.Jobs().Info(update.Job, &api.QueryOptions{Namespace: update.Namespace})
+	if err != nil {
+		return nil, &NomadError{Namespace: update.Namespace, Err: err}
+	}
+
+	plan := &JobPlan{Job: job, ModifyIndex: *job.JobModifyIndex}
+	for _, taskUpdate := range update.Tasks {
+		skip := func(err error) {
+			plan.Skipped = append(plan.Skipped, SkippedTask{Group: taskUpdate.Group, Task: taskUpdate.Task, Err: err})
+		}
+
+		task := lookupTask(job, taskUpdate.Group, taskUpdate.Task)
+		if task == nil {
+			skip(fmt.Errorf("not found in job %s", update.Job))
+			continue
+		}
+
+		imageKey := taskUpdate.ImageKey
+		if imageKey == "" {
+			imageKey = defaultImageKey
+		}
+
+		image, ok := task.Config[imageKey].(string)
+		if !ok {
+			skip(errors.New("has no image"))
+			continue
+		}
+
+		newImage, err := replaceTag(image, taskUpdate.Image, taskUpdate.FromTag, taskUpdate.ToTag)
+		if err != nil {
+			skip(err)
+			continue
+		}
+		task.Config[imageKey] = newImage
+
+		plan.Changes = append(plan.Changes, ImageChange{
+			Group: taskUpdate.Group,
+			Task:  taskUpdate.Task,
+			From:  image,
+			To:    newImage,
+		})
+	}
+
+	return plan, nil
+}
+
+// RegisterPlan registers the planned job, unless it has been modified since
+// it was planned.
+func RegisterPlan(client *api.Client, plan *JobPlan) error {
+	_, _, err := client.Jobs().EnforceRegister(plan.Job, plan.ModifyIndex, &api.WriteOptions{Namespace: *plan.Job.Namespace})
+	if err != nil {
+		return &NomadError{Namespace: *plan.Job.Namespace, Err: err}
+	}
+	return nil
+}
+
+func lookupTask(job *api.Job, group, name string) *api.Task {
+	tg := job.LookupTaskGroup(group)
+	if tg == nil {
+		return nil
+	}
+
+	for _, task := range tg.Tasks {
+		if task.Name == name {
+			return task
+		}
+	}
+	return nil
+}
+
+// replaceTag changes the tag of image from fromTag to tag, keeping the name
+// as written in the job spec (e.g. "redis" rather than
+// "docker.io/library/redis"). Images whose tag has changed since the scan,
+// e.g. because the job was updated by hand, aren't rewritten, and neither are
+// images pinned by digest, whose pin would be lost.
+func replaceTag(image, name, fromTag, tag string) (string, error) {
+	if strings.Contains(image, "${") {
+		return "", fmt.Errorf("image %s is interpolated and can't be rewritten", image)
+	}
+
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return "", err
+	}
+
+	if named.Name() != name {
+		return "", fmt.Errorf("image %s in the job spec no longer refers to %s", image, name)
+	}
+
+	if _, ok := named.(reference.Digested); ok {
+		return "", fmt.Errorf("image %s is pinned by digest and can't be rewritten", image)
+	}
+
+	if tagged, ok := reference.TagNameOnly(named).(reference.NamedTagged); !ok || tagged.Tag() != fromTag {
+		return "", fmt.Errorf("image %s in the job spec is no longer tagged %s", image, fromTag)
+	}
+
+	repo := image
+	if i := strings.LastIndexByte(repo, ':'); i > strings.LastIndexByte(repo, '/') {
+		repo = repo[:i]
+	}
+
+	return repo + ":" + tag, nil
+}
@@ -0,0 +1,83 @@
+package scanner
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/nomad/api"
+)
+
+func TestReplaceTag(t *testing.T) {
+	tests := []struct {
+		image   string
+		name    string
+		fromTag string
+		tag     string
+		want    string
+		wantErr bool
+	}{
+		{"redis:7.0.0", "docker.io/library/redis", "7.0.0", "7.2.0", "redis:7.2.0", false},
+		{"registry.internal:5000/team/app:1.0", "registry.internal:5000/team/app", "1.0", "1.1", "registry.internal:5000/team/app:1.1", false},
+		{"redis", "docker.io/library/redis", "latest", "7.2.0", "redis:7.2.0", false},
+		// The spec was bumped since the scan.
+		{"redis:7.1.0", "docker.io/library/redis", "7.0.0", "7.2.0", "", true},
+		{"postgres:16", "docker.io/library/redis", "16", "17", "", true},
+		{"redis:7.0.0@sha256:0123456789012345678901234567890123456789012345678901234567890123", "docker.io/library/redis", "7.0.0", "7.2.0", "", true},
+		{"redis@sha256:0123456789012345678901234567890123456789012345678901234567890123", "docker.io/library/redis", "", "7.2.0", "", true},
+		{"redis:${VERSION}", "docker.io/library/redis", "7.0.0", "7.2.0", "", true},
+	}
+	for _, tt := range tests {
+		got, err := replaceTag(tt.image, tt.name, tt.fromTag, tt.tag)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("replaceTag(%q, %q, %q, %q) = %q, %v, want %q, error %t", tt.image, tt.name, tt.fromTag, tt.tag, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestPlanUpdateSkipsTasks(t *testing.T) {
+	job := testAllocation("a1", "default", "web", "redis:7.0.0").Job
+	job.JobModifyIndex = new(uint64)
+	tg := job.TaskGroups[0]
+	tg.Tasks = append(tg.Tasks,
+		&api.Task{Name: "interpolated", Driver: "docker", Config: map[string]interface{}{"image": "redis:${VERSION}"}},
+		&api.Task{Name: "bumped", Driver: "docker", Config: map[string]interface{}{"image": "redis:7.1.0"}},
+	)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/job/web" {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(job)
+	}))
+	defer srv.Close()
+
+	client, err := api.NewClient(&api.Config{Address: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	update := JobUpdate{Namespace: "default", Job: "web"}
+	for _, task := range []string{"web", "interpolated", "bumped", "missing"} {
+		update.Tasks = append(update.Tasks, TaskUpdate{Group: "web", Task: task, Image: "docker.io/library/redis", FromTag: "7.0.0", ToTag: "7.2.0"})
+	}
+
+	plan, err := PlanUpdate(client, update)
+	if err != nil {
+		t.Fatalf("PlanUpdate() error = %v", err)
+	}
+
+	if want := []ImageChange{{Group: "web", Task: "web", From: "redis:7.0.0", To: "redis:7.2.0"}}; !reflect.DeepEqual(plan.Changes, want) {
+		t.Errorf("Changes = %+v, want %+v", plan.Changes, want)
+	}
+	var skipped []string
+	for _, task := range plan.Skipped {
+		skipped = append(skipped, task.Task)
+	}
+	if want := []string{"interpolated", "bumped", "missing"}; !reflect.DeepEqual(skipped, want) {
+		t.Errorf("Skipped = %q, want %q", skipped, want)
+	}
+}
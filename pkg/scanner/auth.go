@@ -0,0 +1,239 @@
+package scanner
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	"github.com/docker/cli/cli/config"
+	"github.com/docker/cli/cli/config/types"
+	"github.com/docker/docker-credential-helpers/client"
+	"github.com/docker/docker-credential-helpers/credentials"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/google"
+)
+
+// defaultECRHelper is the Amazon ECR docker credential helper, which
+// authenticates using the AWS SDK default credential chain.
+const defaultECRHelper = "docker-credential-ecr-login"
+
+// defaultACRHelper is the Azure Container Registry docker credential helper,
+// which authenticates with Azure AD using the AZURE_* environment variables.
+const defaultACRHelper = "docker-credential-acr-env"
+
+var ecrHostRegexp = regexp.MustCompile(`^[0-9]{12}\.dkr\.ecr(-fips)?\.[a-z0-9-]+\.amazonaws\.com(\.cn)?$`)
+
+var acrHostRegexp = regexp.MustCompile(`^[a-z0-9]+\.azurecr\.(io|cn|de|us)$`)
+
+func getKeychain(conf RegistryAuth) authn.Keychain {
+	var keychain authn.Keychain = authn.DefaultKeychain
+	if conf.DockerConfig != "" {
+		keychain = dockerConfigKeychain{dir: conf.DockerConfig}
+	}
+
+	ecrHelper := conf.ECRHelper
+	if ecrHelper == "" {
+		ecrHelper = defaultECRHelper
+	}
+
+	acrHelper := conf.ACRHelper
+	if acrHelper == "" {
+		acrHelper = defaultACRHelper
+	}
+
+	// MultiKeychain uses the first keychain that doesn't resolve to
+	// anonymous, so the helpers only kick in for ECR and ACR hosts and the
+	// Google keychain only for GCR and Artifact Registry hosts.
+	keychains := []authn.Keychain{
+		credentialHelperKeychain{helper: ecrHelper, hosts: ecrHostRegexp},
+		credentialHelperKeychain{helper: acrHelper, hosts: acrHostRegexp},
+	}
+	if conf.Google {
+		keychains = append(keychains, google.Keychain)
+	}
+
+	return authn.NewMultiKeychain(append(keychains, keychain)...)
+}
+
+// dockerConfigKeychain behaves like authn.DefaultKeychain but reads the
+// config.json from a fixed directory instead of $DOCKER_CONFIG.
+type dockerConfigKeychain struct {
+	dir string
+}
+
+func (k dockerConfigKeychain) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	cf, err := config.Load(k.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	key := target.RegistryStr()
+	if key == name.DefaultRegistry {
+		key = authn.DefaultAuthKey
+	}
+
+	cfg, err := cf.GetAuthConfig(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg == (types.AuthConfig{}) {
+		return authn.Anonymous, nil
+	}
+	return authn.FromConfig(authn.AuthConfig{
+		Username:      cfg.Username,
+		Password:      cfg.Password,
+		Auth:          cfg.Auth,
+		IdentityToken: cfg.IdentityToken,
+		RegistryToken: cfg.RegistryToken,
+	}), nil
+}
+
+// credentialHelperKeychain resolves credentials for the registries matching
+// hosts through a docker credential helper program, regardless of whether it
+// is configured in the docker config.json.
+type credentialHelperKeychain struct {
+	helper string
+	hosts  *regexp.Regexp
+}
+
+func (k credentialHelperKeychain) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	if !k.hosts.MatchString(target.RegistryStr()) {
+		return authn.Anonymous, nil
+	}
+
+	// Without the helper installed, fall through to the other keychains so
+	// that credentials from `docker login` still work.
+	if _, err := exec.LookPath(k.helper); err != nil {
+		return authn.Anonymous, nil
+	}
+
+	creds, err := client.Get(client.NewShellProgramFunc(k.helper), target.RegistryStr())
+	if credentials.IsErrCredentialsNotFound(err) {
+		return authn.Anonymous, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return authn.FromConfig(authn.AuthConfig{
+		Username: creds.Username,
+		Password: creds.Secret,
+	}), nil
+}
+
+// imageKeychain resolves the credentials configured on watched images, using
+// base for repositories without any.
+type imageKeychain struct {
+	auths map[string]authn.Authenticator
+	base  authn.Keychain
+}
+
+func newImageKeychain(images []WatchedImage, base authn.Keychain) (authn.Keychain, error) {
+	auths := make(map[string]authn.Authenticator)
+	for _, image := range images {
+		if image.Username == "" && image.Password == "" && image.Token == "" {
+			continue
+		}
+
+		repo, err := registryRepository(image)
+		if err != nil {
+			return nil, err
+		}
+
+		username, err := expandEnvRef(image.Username)
+		if err != nil {
+			return nil, fmt.Errorf("username for %s: %w", image.Name, err)
+		}
+		password, err := expandEnvRef(image.Password)
+		if err != nil {
+			return nil, fmt.Errorf("password for %s: %w", image.Name, err)
+		}
+		token, err := expandEnvRef(image.Token)
+		if err != nil {
+			return nil, fmt.Errorf("token for %s: %w", image.Name, err)
+		}
+
+		auths[repo.String()] = authn.FromConfig(authn.AuthConfig{
+			Username:      username,
+			Password:      password,
+			RegistryToken: token,
+		})
+	}
+
+	if len(auths) == 0 {
+		return base, nil
+	}
+
+	return imageKeychain{auths: auths, base: base}, nil
+}
+
+func (k imageKeychain) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	if auth, ok := k.auths[target.String()]; ok {
+		return auth, nil
+	}
+	return k.base.Resolve(target)
+}
+
+// registryTokenKeychain resolves the static bearer tokens configured on
+// registries, using base for the other registries.
+type registryTokenKeychain struct {
+	auths map[string]authn.Authenticator
+	base  authn.Keychain
+}
+
+// newRegistryTokenKeychain returns a keychain sending the registries' static
+// tokens as is, which skips the token exchange for registries that don't
+// implement it. The transport only sends a token to its own registry host,
+// also when redirected.
+func newRegistryTokenKeychain(registries map[string]RegistryConfig, base authn.Keychain) (authn.Keychain, error) {
+	auths := make(map[string]authn.Authenticator)
+	for host, registry := range registries {
+		if registry.Token == "" {
+			continue
+		}
+
+		token, err := expandEnvRef(registry.Token)
+		if err != nil {
+			return nil, fmt.Errorf("token for registry %s: %w", host, err)
+		}
+
+		auths[host] = authn.FromConfig(authn.AuthConfig{RegistryToken: token})
+	}
+
+	if len(auths) == 0 {
+		return base, nil
+	}
+
+	return registryTokenKeychain{auths: auths, base: base}, nil
+}
+
+func (k registryTokenKeychain) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	if auth, ok := k.auths[target.RegistryStr()]; ok {
+		return auth, nil
+	}
+	return k.base.Resolve(target)
+}
+
+// expandEnvRef replaces a value of the form $NAME or ${NAME} with the
+// environment variable NAME, so that secrets needn't be stored in the config.
+// Any other value is returned as is.
+func expandEnvRef(value string) (string, error) {
+	if !strings.HasPrefix(value, "$") {
+		return value, nil
+	}
+
+	key := strings.TrimPrefix(value, "$")
+	if strings.HasPrefix(key, "{") && strings.HasSuffix(key, "}") {
+		key = key[1 : len(key)-1]
+	}
+
+	expanded, ok := os.LookupEnv(key)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", key)
+	}
+
+	return expanded, nil
+}
@@ -0,0 +1,125 @@
+package scanner
+
+import (
+	"sync"
+	"time"
+)
+
+// tagCache keeps the tags of each repository for ttl so that repeated scans
+// don't hit registry rate limits. A zero ttl disables caching.
+type tagCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]tagCacheEntry
+	hits    int
+	misses  int
+}
+
+type tagCacheEntry struct {
+	tags    []string
+	expires time.Time
+}
+
+func newTagCache(ttl time.Duration) *tagCache {
+	return &tagCache{
+		ttl:     ttl,
+		entries: make(map[string]tagCacheEntry),
+	}
+}
+
+func (c *tagCache) get(repo string) ([]string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[repo]
+	if !ok || time.Now().After(entry.expires) {
+		c.misses++
+		return nil, false
+	}
+
+	c.hits++
+	return entry.tags, true
+}
+
+func (c *tagCache) put(repo string, tags []string) {
+	if c.ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[repo] = tagCacheEntry{
+		tags:    tags,
+		expires: time.Now().Add(c.ttl),
+	}
+}
+
+func (c *tagCache) stats() (hits, misses int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.hits, c.misses
+}
+
+// allocCache keeps the instances of each allocation along with the modify
+// index it had when looked up, so that repeated scans only look up the
+// allocations that changed since.
+type allocCache struct {
+	mu      sync.Mutex
+	entries map[string]allocCacheEntry
+	// listed holds the allocations listed since the last prune.
+	listed map[string]bool
+}
+
+type allocCacheEntry struct {
+	modifyIndex uint64
+	instances   []Instance
+}
+
+func newAllocCache() *allocCache {
+	return &allocCache{
+		entries: make(map[string]allocCacheEntry),
+		listed:  make(map[string]bool),
+	}
+}
+
+// get returns the instances of the allocation unless it has been modified
+// since they were cached.
+func (c *allocCache) get(id string, modifyIndex uint64) ([]Instance, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.listed[id] = true
+	entry, ok := c.entries[id]
+	if !ok || entry.modifyIndex != modifyIndex {
+		return nil, false
+	}
+
+	return append([]Instance(nil), entry.instances...), true
+}
+
+func (c *allocCache) put(id string, modifyIndex uint64, instances []Instance) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[id] = allocCacheEntry{
+		modifyIndex: modifyIndex,
+		instances:   append([]Instance(nil), instances...),
+	}
+}
+
+// prune drops the allocations that haven't been listed since the previous
+// prune, such as those garbage collected by Nomad.
+func (c *allocCache) prune() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for id := range c.entries {
+		if !c.listed[id] {
+			delete(c.entries, id)
+		}
+	}
+	c.listed = make(map[string]bool)
+}
@@ -0,0 +1,78 @@
+package scanner
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/go-version"
+)
+
+// VersionSchemeSemver and VersionSchemeCalVer are the
+// WatchedImage.VersionScheme values.
+const (
+	VersionSchemeSemver = "semver"
+	VersionSchemeCalVer = "calver"
+
+	// calVerSegments is the most parts a calendar release has: the year,
+	// the month, and e.g. the day and a micro version.
+	calVerSegments = 4
+)
+
+// parseCalVer parses a calendar version such as 2024.03, 24.3.1 or
+// 2024.03.01-2. Two digit years are taken as 20YY so that both forms order
+// together, and a numeric suffix is a revision of the release rather than a
+// prerelease. Other suffixes, such as -rc1, are prereleases.
+//
+// The result is an ordinary version whose segments are the year, the month
+// and the remaining parts, so that it sorts and compares like any other. A
+// revision follows the release padded to calVerSegments, so that it only
+// breaks ties between equal releases: 2024.03-2 is 2024.3.0.0.2, which sorts
+// below 2024.03.01.
+func parseCalVer(s string) (*version.Version, error) {
+	release, suffix, _ := strings.Cut(s, "-")
+
+	parts := strings.Split(release, ".")
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("calendar version %s has no month", s)
+	}
+	if len(parts) > calVerSegments {
+		return nil, fmt.Errorf("calendar version %s has more than %d parts", s, calVerSegments)
+	}
+
+	segments := make([]int, 0, len(parts)+1)
+	for _, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("calendar version %s: %q isn't a number", s, part)
+		}
+		segments = append(segments, n)
+	}
+
+	switch year := segments[0]; {
+	case year < 100:
+		segments[0] += 2000
+	case year < 1970:
+		return nil, fmt.Errorf("calendar version %s: %d isn't a year", s, year)
+	}
+	if month := segments[1]; month < 1 || month > 12 {
+		return nil, fmt.Errorf("calendar version %s: %d isn't a month", s, month)
+	}
+
+	var prerelease string
+	if revision, err := strconv.Atoi(suffix); suffix != "" && err == nil && revision >= 0 {
+		for len(segments) < calVerSegments {
+			segments = append(segments, 0)
+		}
+		segments = append(segments, revision)
+	} else if suffix != "" {
+		prerelease = "-" + suffix
+	}
+
+	normalized := make([]string, len(segments))
+	for i, n := range segments {
+		normalized[i] = strconv.Itoa(n)
+	}
+
+	return version.NewVersion(strings.Join(normalized, ".") + prerelease)
+}
@@ -0,0 +1,57 @@
+package scanner
+
+import "testing"
+
+func TestParseCalVer(t *testing.T) {
+	tests := []struct {
+		name    string
+		version string
+		want    string
+		wantErr bool
+	}{
+		{name: "year and month", version: "2024.03", want: "2024.3.0"},
+		{name: "two digit year", version: "24.04", want: "2024.4.0"},
+		{name: "day", version: "2024.03.01", want: "2024.3.1"},
+		{name: "revision", version: "2024.03-2", want: "2024.3.0.0.2"},
+		{name: "revision of a day", version: "2024.03.01-2", want: "2024.3.1.0.2"},
+		{name: "prerelease", version: "2024.03-rc1", want: "2024.3.0-rc1"},
+		{name: "no month", version: "2024", wantErr: true},
+		{name: "bad month", version: "2024.13", wantErr: true},
+		{name: "too many parts", version: "2024.03.01.1.1", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseCalVer(tt.version)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseCalVer(%q) = %s, want an error", tt.version, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseCalVer(%q) error = %v", tt.version, err)
+			}
+			if got.String() != tt.want {
+				t.Errorf("parseCalVer(%q) = %s, want %s", tt.version, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseCalVerOrder(t *testing.T) {
+	// Each version sorts strictly below the next.
+	ordered := []string{"2024.03-rc1", "2024.03", "2024.03-2", "2024.03-5", "2024.03.01", "2024.03.01-2", "2024.03.02", "24.04"}
+	for i := 1; i < len(ordered); i++ {
+		lower, err := parseCalVer(ordered[i-1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		higher, err := parseCalVer(ordered[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !lower.LessThan(higher) {
+			t.Errorf("%s (%s) doesn't sort below %s (%s)", ordered[i-1], lower, ordered[i], higher)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package scanner
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+const (
+	catalogPath  = "v2/_catalog"
+	catalogScope = "registry:catalog:*"
+)
+
+// getCatalogImages returns the repositories of the registries with a catalog
+// configured that match its patterns and aren't watched yet. Registries whose
+// catalog can't be listed are logged and skipped.
+func getCatalogImages(ctx context.Context, conf Config, registry *registryClient) []WatchedImage {
+	var hosts []string
+	for host, registryConf := range conf.Registries {
+		if registryConf.Catalog != nil {
+			hosts = append(hosts, host)
+		}
+	}
+	sort.Strings(hosts)
+
+	seen := make(map[string]bool)
+	for _, image := range conf.Images {
+		seen[image.Name] = true
+	}
+
+	var discovered []WatchedImage
+	for _, host := range hosts {
+		catalog := conf.Registries[host].Catalog
+		repos, err := registry.catalog(ctx, host)
+		if err != nil {
+			registry.logger.Warn("listing catalog failed", "registry", host, "error", err)
+			continue
+		}
+
+		for _, repo := range repos {
+			named, err := reference.ParseNormalizedNamed(host + "/" + repo)
+			if err != nil {
+				registry.logger.Debug("skipping catalog repository", "registry", host, "repository", repo, "error", err)
+				continue
+			}
+
+			name := named.Name()
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+
+			if isIncluded(name, catalog.Include) && !isExcluded(name, catalog.Exclude) {
+				registry.logger.Debug("watching catalog image", "image", name)
+				discovered = append(discovered, WatchedImage{Name: name})
+			}
+		}
+	}
+	return discovered
+}
+
+// catalog returns the repositories the registry lists in its catalog,
+// following pagination.
+func (rc *registryClient) catalog(ctx context.Context, host string) ([]string, error) {
+	var opts []name.Option
+	if containsString(rc.insecure, host) {
+		opts = append(opts, name.Insecure)
+	}
+	reg, err := name.NewRegistry(host, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	auth, err := rc.keychain.Resolve(reg)
+	if err != nil {
+		return nil, err
+	}
+
+	setupCtx, cancel := context.WithTimeout(ctx, rc.timeout)
+	defer cancel()
+
+	t, err := transport.NewWithContext(setupCtx, reg, auth, rc.transport(reg), []string{catalogScope})
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Transport: t, Timeout: rc.timeout}
+
+	next, err := url.Parse(fmt.Sprintf("%s://%s/%s", reg.Scheme(), reg.RegistryStr(), catalogPath))
+	if err != nil {
+		return nil, err
+	}
+
+	var repos []string
+	for page := 0; next != nil; page++ {
+		if page == rc.maxPages {
+			return nil, fmt.Errorf("catalog of %s exceeds %d pages", host, rc.maxPages)
+		}
+
+		resp, err := rc.getWithRetry(ctx, client, next.String())
+		if err != nil {
+			return nil, err
+		}
+
+		jsonResp := struct {
+			Repositories []string `json:"repositories"`
+		}{}
+		if err = transport.CheckError(resp, http.StatusOK); err == nil {
+			next, err = decodePage(resp, &jsonResp)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		repos = append(repos, jsonResp.Repositories...)
+	}
+
+	return repos, nil
+}
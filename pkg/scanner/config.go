@@ -0,0 +1,770 @@
+package scanner
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/hashicorp/go-version"
+	"github.com/hashicorp/nomad/api"
+)
+
+type WatchedImage struct {
+	Name       string          `toml:"name"`
+	Include    []TOMLRegexp    `toml:"include"`
+	Exclude    []TOMLRegexp    `toml:"exclude"`
+	Constraint TOMLConstraints `toml:"constraint"`
+	Rolling    []TOMLRegexp    `toml:"rolling"`
+
+	// ComparisonInclude and ComparisonExclude further narrow the tags that
+	// the latest version is chosen from, without hiding the other tags.
+	ComparisonInclude []TOMLRegexp `toml:"comparisonInclude"`
+	ComparisonExclude []TOMLRegexp `toml:"comparisonExclude"`
+
+	// RegistryOverride is the registry host, such as a pull-through mirror,
+	// whose tags are listed instead of those of the image's own registry.
+	// Tasks are still matched by Name.
+	RegistryOverride string `toml:"registryOverride"`
+
+	// MatchAnyRegistry also matches tasks running the image's repository
+	// path from another registry, such as mirror.example.com/library/redis
+	// for redis. Tasks running the image from its own registry still take
+	// precedence.
+	MatchAnyRegistry bool `toml:"matchAnyRegistry"`
+
+	// VersionAnnotation is a manifest annotation, such as
+	// org.opencontainers.image.version, holding the image's version. When set,
+	// the latest version is read from the manifest of AnnotationTag (default
+	// "latest") and tasks running a tag that isn't a version are compared by
+	// the annotation of their tag. Tags without the annotation fall back to
+	// the tag based versions.
+	VersionAnnotation string `toml:"versionAnnotation"`
+	AnnotationTag     string `toml:"annotationTag"`
+
+	// Platform, such as linux/amd64, selects the manifest whose digest is
+	// compared in multi-arch image indexes. Without it the digest of the
+	// index itself is compared, which changes whenever any platform does.
+	Platform string `toml:"platform"`
+
+	// CheckLatest warns when the digest of the image's "latest" tag differs
+	// from that of its newest version, i.e. upstream forgot to move it.
+	CheckLatest bool `toml:"checkLatest"`
+
+	// OverrideDefaults makes Include and Exclude replace the patterns of
+	// Config.Defaults rather than add to them.
+	OverrideDefaults bool `toml:"overrideDefaults"`
+
+	// TagPrefix is stripped from tags, such as "release-" from
+	// release-1.2.3, before parsing them as versions. Tags without it aren't
+	// versions.
+	TagPrefix string `toml:"tagPrefix"`
+
+	// VersionPattern extracts the version from tags through its named group
+	// "version", such as 1.2.3 from app-v1.2.3-prod with
+	// "^app-v(?P<version>.+)-prod$". Tags it doesn't match aren't versions.
+	VersionPattern TOMLRegexp `toml:"versionPattern"`
+
+	// VersionScheme is how versions are parsed from tags: as semantic
+	// versions by default, or with VersionSchemeCalVer as calendar versions
+	// such as 2024.03 or 24.3.1, which orders two and four digit years
+	// together and numeric suffixes as revisions rather than prereleases.
+	VersionScheme string `toml:"versionScheme"`
+
+	// CompareStrategy chooses how the latest tag is picked: CompareSemver,
+	// the default, picks the highest version, and ComparePushDate the most
+	// recently built, for images whose tags don't sort as versions. The
+	// latter reads the image config of every candidate tag on every scan,
+	// one extra registry request per tag, so narrow the candidates with
+	// Include or ComparisonInclude.
+	CompareStrategy string `toml:"compareStrategy"`
+
+	// IncludePrereleases lets versions with a -suffix, such as 2.0.0-rc1,
+	// be reported as the latest version.
+	IncludePrereleases bool `toml:"includePrereleases"`
+
+	// Username, Password and Token override the keychain for this image.
+	// Each may reference an environment variable as $NAME or ${NAME}.
+	Username string `toml:"username"`
+	Password string `toml:"password"`
+	Token    string `toml:"token"`
+}
+
+// parseTag parses the tag as a version after stripping TagPrefix and
+// extracting the VersionPattern group.
+func (image WatchedImage) parseTag(tag string) (*version.Version, error) {
+	v, ok := strings.CutPrefix(tag, image.TagPrefix)
+	if !ok {
+		return nil, fmt.Errorf("tag %s doesn't start with %s", tag, image.TagPrefix)
+	}
+
+	if pattern := image.VersionPattern.Regexp; pattern != nil {
+		match := pattern.FindStringSubmatch(v)
+		if match == nil {
+			return nil, fmt.Errorf("tag %s doesn't match %s", tag, pattern)
+		}
+		v = match[pattern.SubexpIndex("version")]
+	}
+
+	if image.VersionScheme == VersionSchemeCalVer {
+		return parseCalVer(v)
+	}
+	return version.NewVersion(v)
+}
+
+// MatchImages watches the images of tasks whose names, such as
+// "registry.internal/team/app", match one of Include and none of Exclude.
+type MatchImages struct {
+	Include []TOMLRegexp `toml:"include"`
+	Exclude []TOMLRegexp `toml:"exclude"`
+}
+
+// Defaults holds tag patterns applied to every watched image, unless the
+// image sets OverrideDefaults. Include only applies to images without
+// includes of their own.
+type Defaults struct {
+	Include []TOMLRegexp `toml:"include"`
+	Exclude []TOMLRegexp `toml:"exclude"`
+}
+
+// withDefaults returns the image with the default excludes added to its own.
+// The default includes only apply to images without includes of their own,
+// as adding to an image's includes would widen them.
+func (image WatchedImage) withDefaults(defaults Defaults) WatchedImage {
+	if image.OverrideDefaults {
+		return image
+	}
+
+	if len(image.Include) == 0 {
+		image.Include = defaults.Include
+	}
+	image.Exclude = append(image.Exclude[:len(image.Exclude):len(image.Exclude)], defaults.Exclude...)
+	return image
+}
+
+type SlackConfig struct {
+	WebhookURL string `toml:"webhookURL"`
+}
+
+type WebhookConfig struct {
+	URL          string            `toml:"url"`
+	Headers      map[string]string `toml:"headers"`
+	OnlyOnChange bool              `toml:"onlyOnChange"`
+	Timeout      TOMLDuration      `toml:"timeout"`
+}
+
+type RegistryAuth struct {
+	DockerConfig string `toml:"dockerConfig"`
+	ECRHelper    string `toml:"ecrHelper"`
+	ACRHelper    string `toml:"acrHelper"`
+	Google       bool   `toml:"google"`
+}
+
+// NomadTLS configures TLS for the connection to Nomad. The NOMAD_CACERT,
+// NOMAD_CLIENT_CERT, NOMAD_CLIENT_KEY, NOMAD_TLS_SERVER_NAME and
+// NOMAD_SKIP_VERIFY environment variables take precedence.
+type NomadTLS struct {
+	CACert     string `toml:"caCert"`
+	ClientCert string `toml:"clientCert"`
+	ClientKey  string `toml:"clientKey"`
+	ServerName string `toml:"serverName"`
+	SkipVerify bool   `toml:"skipVerify"`
+}
+
+// RegistryConfig configures the connection to a single registry.
+type RegistryConfig struct {
+	// Proxy is the URL of the proxy to reach the registry through instead
+	// of the one from the HTTPS_PROXY and HTTP_PROXY environment variables.
+	Proxy string `toml:"proxy"`
+
+	// CAFile is a PEM bundle of CA certificates trusted in addition to the
+	// system's, for registries with self-signed certificates.
+	CAFile string `toml:"caFile"`
+
+	// InsecureSkipVerify disables the verification of the registry's TLS
+	// certificate. Prefer CAFile, as this allows intercepting connections.
+	InsecureSkipVerify bool `toml:"insecureSkipVerify"`
+
+	// TagsPath is the path the tags of a repository are listed from, with
+	// %s standing for the repository (default "v2/%s/tags/list"), for
+	// registries deviating from the distribution spec.
+	TagsPath string `toml:"tagsPath"`
+
+	// Token is a long-lived bearer token sent to the registry as is, taking
+	// precedence over RegistryAuth. It may reference an environment
+	// variable as $NAME or ${NAME}.
+	Token string `toml:"token"`
+
+	// Catalog watches the repositories of the registry listed by its
+	// catalog API, in addition to the configured images.
+	Catalog *CatalogConfig `toml:"catalog"`
+}
+
+// CatalogConfig selects the repositories of a registry's catalog to watch by
+// their full names, such as registry.internal/team/app, with only the default
+// tag filters. Without Include every repository is watched.
+type CatalogConfig struct {
+	Include []TOMLRegexp `toml:"include"`
+	Exclude []TOMLRegexp `toml:"exclude"`
+}
+
+// Config configures a Scan. It is usually read with ParseConfigFile.
+type Config struct {
+	Server          string         `toml:"server"`
+	Token           string         `toml:"token"`
+	TLS             NomadTLS       `toml:"tls"`
+	Namespaces      []string       `toml:"namespaces"`
+	Jobs            []string       `toml:"jobs"`
+	Sort            string         `toml:"sort"`
+	NoSort          bool           `toml:"noSort"`
+	Images          []WatchedImage `toml:"images"`
+	MatchImages     MatchImages    `toml:"matchImages"`
+	Defaults        Defaults       `toml:"defaults"`
+	RegistryAuth    RegistryAuth   `toml:"registryAuth"`
+	MaxTagPages     int            `toml:"maxTagPages"`
+	MaxRetries      *int           `toml:"maxRetries"`
+	MaxConcurrency  int            `toml:"maxConcurrency"`
+	Source          string         `toml:"source"`
+	CompareDeployed bool           `toml:"compareDeployed"`
+	Drivers         []string       `toml:"drivers"`
+	AllocStatuses   []string       `toml:"allocStatuses"`
+	TagCacheTTL     TOMLDuration   `toml:"tagCacheTTL"`
+	RegistryTimeout TOMLDuration   `toml:"registryTimeout"`
+	ResolveDigests  bool           `toml:"resolveDigests"`
+	Since           time.Time      `toml:"since"`
+	ImageAge        bool           `toml:"imageAge"`
+	LatestMode      string         `toml:"latestMode"`
+	V1Fallback      bool           `toml:"v1Fallback"`
+	Slack           SlackConfig    `toml:"slack"`
+	Webhook         WebhookConfig  `toml:"webhook"`
+
+	// DriverImageKeys maps a driver to the task config key holding its
+	// image, for drivers that don't use "image".
+	DriverImageKeys map[string]string `toml:"driverImageKeys"`
+
+	// Registries is keyed by registry host, e.g. "index.docker.io".
+	Registries map[string]RegistryConfig `toml:"registries"`
+	// InsecureRegistries are the registry hosts, including the port, that
+	// are reached over plain HTTP.
+	InsecureRegistries []string `toml:"insecureRegistries"`
+
+	// RegistryClient lists the tags of the watched images' repositories
+	// instead of their registries' HTTP API if set, e.g. to inject a fake.
+	// Digests and annotations are still read from the registries.
+	RegistryClient RegistryClient `toml:"-"`
+
+	// Logger receives the scan's diagnostics, slog.Default() if unset.
+	Logger *slog.Logger `toml:"-"`
+}
+
+const (
+	// SourceAllocs reads the image each allocation was placed with, while
+	// SourceJobs reads the image from the job spec, needing far fewer API
+	// calls on jobs with many allocations.
+	SourceAllocs = "allocs"
+	SourceJobs   = "jobs"
+
+	// LatestModeDigest compares tasks running the latest tag, or no tag at
+	// all, by digest like rolling tags, and LatestModeReport reports them
+	// with the newest version and a warning instead.
+	LatestModeDigest = "digest"
+	LatestModeReport = "report"
+
+	// CompareSemver and ComparePushDate are the WatchedImage.CompareStrategy
+	// values.
+	CompareSemver   = "semver"
+	ComparePushDate = "pushDate"
+
+	defaultServer         = "127.0.0.1:4646"
+	defaultMaxConcurrency = 10
+	defaultAnnotationTag  = "latest"
+	defaultImageKey       = "image"
+)
+
+// TOMLRegexp is a regular expression compiled while decoding. An invalid
+// pattern doesn't fail decoding but is reported by Config.Validate, so that
+// every mistake in the config is listed at once.
+type TOMLRegexp struct {
+	Regexp *regexp.Regexp
+
+	err error
+}
+
+// UnmarshalTOML accepts either a pattern string or a table such as
+// { pattern = "v1", ignoreCase = true, anchored = true }. Patterns match
+// anywhere in the string unless anchored, which makes them match whole
+// strings only.
+func (tr *TOMLRegexp) UnmarshalTOML(data interface{}) error {
+	var rexString string
+	switch data := data.(type) {
+	case string:
+		rexString = data
+	case map[string]interface{}:
+		var ignoreCase, anchored bool
+		for key, value := range data {
+			var ok bool
+			switch key {
+			case "pattern":
+				rexString, ok = value.(string)
+			case "ignoreCase":
+				ignoreCase, ok = value.(bool)
+			case "anchored":
+				anchored, ok = value.(bool)
+			default:
+				return fmt.Errorf("unknown key %q", key)
+			}
+			if !ok {
+				return fmt.Errorf("invalid %s %v", key, value)
+			}
+		}
+
+		if rexString == "" {
+			return errors.New("pattern must be set")
+		}
+		if anchored {
+			rexString = `\A(?:` + rexString + `)\z`
+		}
+		if ignoreCase {
+			rexString = "(?i)" + rexString
+		}
+	default:
+		return errors.New("value must be a string or a table")
+	}
+
+	tr.Regexp, tr.err = regexp.Compile(rexString)
+
+	return nil
+}
+
+type TOMLConstraints struct {
+	Constraints version.Constraints
+}
+
+func (tc *TOMLConstraints) UnmarshalTOML(data interface{}) error {
+	constraintString, ok := data.(string)
+	if !ok {
+		return errors.New("value must be a string")
+	}
+
+	constraints, err := version.NewConstraint(constraintString)
+	if err != nil {
+		return err
+	}
+
+	tc.Constraints = constraints
+
+	return nil
+}
+
+type TOMLDuration struct {
+	Duration time.Duration
+}
+
+func (td *TOMLDuration) UnmarshalTOML(data interface{}) error {
+	durationString, ok := data.(string)
+	if !ok {
+		return errors.New("value must be a string")
+	}
+
+	duration, err := time.ParseDuration(durationString)
+	if err != nil {
+		return err
+	}
+
+	td.Duration = duration
+
+	return nil
+}
+
+// ParseConfig reads a TOML config and normalizes it.
+func ParseConfig(r io.Reader) (Config, error) {
+	var conf Config
+	if _, err := toml.NewDecoder(r).Decode(&conf); err != nil {
+		return Config{}, &ConfigError{Err: err}
+	}
+
+	return conf.normalize()
+}
+
+// ParseConfigFile reads a TOML config file and normalizes it. The path "-"
+// reads the config from stdin.
+func ParseConfigFile(path string) (Config, error) {
+	return ParseConfigFiles(path)
+}
+
+// ParseConfigFiles reads and merges TOML config files, then normalizes the
+// result. Settings of later files override those of earlier ones, key by key
+// within tables such as registries, while lists other than images and
+// namespaces, which are combined, are replaced. An image watched by several
+// files uses the settings of the last one.
+func ParseConfigFiles(paths ...string) (Config, error) {
+	var conf Config
+	for _, path := range paths {
+		fileConf, md, err := decodeConfigFile(path)
+		if err != nil {
+			return Config{}, err
+		}
+
+		conf = conf.merge(fileConf, md)
+	}
+
+	return conf.normalize()
+}
+
+func decodeConfigFile(path string) (Config, toml.MetaData, error) {
+	var conf Config
+	if path == "-" {
+		md, err := toml.NewDecoder(os.Stdin).Decode(&conf)
+		if err != nil {
+			return Config{}, toml.MetaData{}, &ConfigError{Path: "stdin", Err: err}
+		}
+		return conf, md, nil
+	}
+
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return Config{}, toml.MetaData{}, &ConfigError{Err: fmt.Errorf("config file %s does not exist", path)}
+	}
+
+	md, err := toml.DecodeFile(path, &conf)
+	if err != nil {
+		return Config{}, toml.MetaData{}, &ConfigError{Path: path, Err: err}
+	}
+
+	return conf, md, nil
+}
+
+// merge returns the config with the keys defined in other's metadata taken
+// from other. Tables, such as matchImages, and maps, such as registries, are
+// merged key by key, while lists are replaced.
+func (conf Config) merge(other Config, md toml.MetaData) Config {
+	mergeFields(reflect.ValueOf(&conf).Elem(), reflect.ValueOf(other), md)
+
+	for _, namespace := range other.Namespaces {
+		if !containsString(conf.Namespaces, namespace) {
+			conf.Namespaces = append(conf.Namespaces, namespace)
+		}
+	}
+
+	// Only images of earlier files are replaced, duplicates within a file
+	// are left for Validate to report.
+	earlier := len(conf.Images)
+	conf.Images = append([]WatchedImage(nil), conf.Images...)
+	for _, image := range other.Images {
+		replaced := false
+		for i, existing := range conf.Images[:earlier] {
+			if sameImage(existing.Name, image.Name) {
+				conf.Images[i] = image
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			conf.Images = append(conf.Images, image)
+		}
+	}
+
+	return conf
+}
+
+// mergeFields sets the fields of dst whose keys, below the table at path, are
+// defined in md to those of src. Images and namespaces are left to merge.
+func mergeFields(dst, src reflect.Value, md toml.MetaData, path ...string) {
+	for i := 0; i < dst.NumField(); i++ {
+		key := dst.Type().Field(i).Tag.Get("toml")
+		if key == "" || key == "-" || !md.IsDefined(append(path, key)...) {
+			continue
+		}
+		if len(path) == 0 && (key == "images" || key == "namespaces") {
+			continue
+		}
+
+		field := dst.Field(i)
+		switch {
+		case field.Kind() == reflect.Struct && isTable(field.Type()):
+			mergeFields(field, src.Field(i), md, append(path, key)...)
+		case field.Kind() == reflect.Map && !field.IsNil():
+			// Copy the map, which other configs may share.
+			merged := reflect.MakeMap(field.Type())
+			for _, values := range []reflect.Value{field, src.Field(i)} {
+				iter := values.MapRange()
+				for iter.Next() {
+					merged.SetMapIndex(iter.Key(), iter.Value())
+				}
+			}
+			field.Set(merged)
+		default:
+			field.Set(src.Field(i))
+		}
+	}
+}
+
+// isTable reports whether the struct is decoded from a TOML table of its own
+// keys, rather than from a single value like TOMLDuration.
+func isTable(t reflect.Type) bool {
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Tag.Get("toml") != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// imageKey returns the task config key holding the image of tasks using
+// driver.
+func (conf Config) imageKey(driver string) string {
+	if key, ok := conf.DriverImageKeys[driver]; ok {
+		return key
+	}
+	return defaultImageKey
+}
+
+// sameImage reports whether two image names refer to the same repository,
+// e.g. "redis" and "docker.io/library/redis".
+func sameImage(a, b string) bool {
+	normA, errA := reference.ParseNormalizedNamed(a)
+	normB, errB := reference.ParseNormalizedNamed(b)
+	if errA != nil || errB != nil {
+		return a == b
+	}
+	return normA.Name() == normB.Name()
+}
+
+// Validate checks the config for mistakes, returning an error that lists all
+// of them.
+func (conf Config) Validate() error {
+	var errs []error
+
+	seen := make(map[string]int)
+	seenPaths := make(map[string]int)
+	for i, image := range conf.Images {
+		prefix := fmt.Sprintf("images[%d]", i)
+		if image.Name == "" {
+			errs = append(errs, fmt.Errorf("%s: name must not be empty", prefix))
+		} else if normName, err := reference.ParseNormalizedNamed(image.Name); err != nil {
+			errs = append(errs, fmt.Errorf("%s: invalid name %q: %w", prefix, image.Name, err))
+		} else if j, ok := seen[normName.Name()]; ok {
+			errs = append(errs, fmt.Errorf("%s: %s is already watched by images[%d]", prefix, image.Name, j))
+		} else {
+			seen[normName.Name()] = i
+
+			if image.MatchAnyRegistry {
+				if j, ok := seenPaths[reference.Path(normName)]; ok {
+					errs = append(errs, fmt.Errorf("%s: matchAnyRegistry is ambiguous with images[%d] of the same repository path", prefix, j))
+				} else {
+					seenPaths[reference.Path(normName)] = i
+				}
+			}
+		}
+
+		if image.VersionPattern.err != nil {
+			errs = append(errs, fmt.Errorf("%s.versionPattern: %w", prefix, image.VersionPattern.err))
+		} else if pattern := image.VersionPattern.Regexp; pattern != nil && pattern.SubexpIndex("version") < 0 {
+			errs = append(errs, fmt.Errorf("%s.versionPattern: %s has no group named version", prefix, pattern))
+		}
+
+		switch image.VersionScheme {
+		case "", VersionSchemeSemver, VersionSchemeCalVer:
+		default:
+			errs = append(errs, fmt.Errorf("%s: unknown versionScheme %q", prefix, image.VersionScheme))
+		}
+
+		switch image.CompareStrategy {
+		case "", CompareSemver:
+		case ComparePushDate:
+			if image.VersionAnnotation != "" {
+				errs = append(errs, fmt.Errorf("%s: compareStrategy %q can't be combined with versionAnnotation", prefix, ComparePushDate))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("%s: unknown compareStrategy %q", prefix, image.CompareStrategy))
+		}
+
+		if image.Platform != "" {
+			if _, err := parsePlatform(image.Platform); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", prefix, err))
+			}
+		}
+
+		if image.RegistryOverride != "" {
+			if _, err := name.NewRegistry(image.RegistryOverride); err != nil {
+				errs = append(errs, fmt.Errorf("%s: invalid registryOverride: %w", prefix, err))
+			}
+		}
+
+		errs = append(errs, validatePatterns(prefix+".include", image.Include)...)
+		errs = append(errs, validatePatterns(prefix+".exclude", image.Exclude)...)
+		errs = append(errs, validatePatterns(prefix+".rolling", image.Rolling)...)
+		errs = append(errs, validatePatterns(prefix+".comparisonInclude", image.ComparisonInclude)...)
+		errs = append(errs, validatePatterns(prefix+".comparisonExclude", image.ComparisonExclude)...)
+	}
+
+	errs = append(errs, validatePatterns("matchImages.include", conf.MatchImages.Include)...)
+	errs = append(errs, validatePatterns("matchImages.exclude", conf.MatchImages.Exclude)...)
+	errs = append(errs, validatePatterns("defaults.include", conf.Defaults.Include)...)
+	errs = append(errs, validatePatterns("defaults.exclude", conf.Defaults.Exclude)...)
+
+	for _, namespace := range conf.Namespaces {
+		if namespace == "" {
+			errs = append(errs, errors.New("namespaces must not contain an empty namespace"))
+			break
+		}
+	}
+
+	for i, pattern := range conf.Jobs {
+		if _, err := path.Match(strings.TrimPrefix(pattern, "!"), ""); err != nil {
+			errs = append(errs, fmt.Errorf("jobs[%d]: invalid pattern %q: %w", i, pattern, err))
+		}
+	}
+
+	if conf.Sort != "" {
+		if _, err := parseSortSpec(conf.Sort); err != nil {
+			errs = append(errs, fmt.Errorf("sort: %w", err))
+		}
+	}
+
+	for host, registry := range conf.Registries {
+		if registry.Proxy != "" {
+			if _, err := url.Parse(registry.Proxy); err != nil {
+				errs = append(errs, fmt.Errorf("registries.%s.proxy: %w", host, err))
+			}
+		}
+		if registry.CAFile != "" {
+			if _, err := os.Stat(registry.CAFile); err != nil {
+				errs = append(errs, fmt.Errorf("registries.%s.caFile: %w", host, err))
+			}
+		}
+		if registry.Catalog != nil {
+			errs = append(errs, validatePatterns(fmt.Sprintf("registries.%s.catalog.include", host), registry.Catalog.Include)...)
+			errs = append(errs, validatePatterns(fmt.Sprintf("registries.%s.catalog.exclude", host), registry.Catalog.Exclude)...)
+		}
+		if registry.TagsPath != "" && (strings.Count(registry.TagsPath, "%") != 1 || !strings.Contains(registry.TagsPath, "%s")) {
+			errs = append(errs, fmt.Errorf("registries.%s.tagsPath must contain %%s for the repository and no other verbs", host))
+		}
+	}
+
+	switch conf.Source {
+	case "", SourceAllocs, SourceJobs:
+	default:
+		errs = append(errs, fmt.Errorf("unknown source %q", conf.Source))
+	}
+	if conf.CompareDeployed && conf.Source != SourceJobs {
+		errs = append(errs, fmt.Errorf("compareDeployed requires source %q", SourceJobs))
+	}
+
+	switch conf.LatestMode {
+	case "", LatestModeDigest, LatestModeReport:
+	default:
+		errs = append(errs, fmt.Errorf("unknown latestMode %q", conf.LatestMode))
+	}
+
+	for driver, key := range conf.DriverImageKeys {
+		if key == "" {
+			errs = append(errs, fmt.Errorf("driverImageKeys.%s: key is empty", driver))
+		}
+	}
+
+	if conf.MaxTagPages < 0 {
+		errs = append(errs, errors.New("maxTagPages must not be negative"))
+	}
+	if conf.MaxRetries != nil && *conf.MaxRetries < 0 {
+		errs = append(errs, errors.New("maxRetries must not be negative"))
+	}
+	if conf.MaxConcurrency < 0 {
+		errs = append(errs, errors.New("maxConcurrency must not be negative"))
+	}
+	if conf.TagCacheTTL.Duration < 0 {
+		errs = append(errs, errors.New("tagCacheTTL must not be negative"))
+	}
+	if conf.RegistryTimeout.Duration < 0 {
+		errs = append(errs, errors.New("registryTimeout must not be negative"))
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return &ConfigError{Err: errors.Join(errs...)}
+}
+
+func validatePatterns(key string, patterns []TOMLRegexp) []error {
+	var errs []error
+	for i, pattern := range patterns {
+		if pattern.err != nil {
+			errs = append(errs, fmt.Errorf("%s[%d]: %w", key, i, pattern.err))
+		} else if pattern.Regexp == nil {
+			errs = append(errs, fmt.Errorf("%s[%d]: pattern must not be empty", key, i))
+		}
+	}
+	return errs
+}
+
+// normalize returns a copy of the config with normalized image names and
+// defaults filled in. It is idempotent so that both ParseConfigFile and Scan
+// can apply it.
+func (conf Config) normalize() (Config, error) {
+	if err := conf.Validate(); err != nil {
+		return Config{}, err
+	}
+
+	conf.Images = append([]WatchedImage(nil), conf.Images...)
+	for i, image := range conf.Images {
+		normName, err := reference.ParseNormalizedNamed(image.Name)
+		if err != nil {
+			return Config{}, err
+		}
+
+		conf.Images[i].Name = normName.Name()
+
+		if image.VersionAnnotation != "" && image.AnnotationTag == "" {
+			conf.Images[i].AnnotationTag = defaultAnnotationTag
+		}
+	}
+
+	if conf.Logger == nil {
+		conf.Logger = slog.Default()
+	}
+
+	if conf.Server == "" {
+		conf.Server = defaultServer
+	}
+
+	// An empty namespace list means all namespaces, the same as the empty
+	// namespace does in getInstances.
+	if len(conf.Namespaces) == 0 {
+		conf.Namespaces = []string{"*"}
+	}
+
+	if conf.MaxConcurrency <= 0 {
+		conf.MaxConcurrency = defaultMaxConcurrency
+	}
+
+	if len(conf.Drivers) == 0 {
+		conf.Drivers = []string{"docker"}
+	}
+
+	if len(conf.AllocStatuses) == 0 {
+		conf.AllocStatuses = []string{api.AllocClientStatusRunning}
+	}
+
+	if conf.LatestMode == "" {
+		conf.LatestMode = LatestModeDigest
+	}
+
+	if conf.Source == "" {
+		conf.Source = SourceAllocs
+	}
+
+	if conf.Sort == "" {
+		conf.Sort = defaultSort
+	}
+
+	return conf, nil
+}
@@ -0,0 +1,184 @@
+package scanner
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestParseConfigEmpty(t *testing.T) {
+	conf, err := ParseConfig(strings.NewReader(""))
+	if err != nil {
+		t.Fatalf("ParseConfig() error = %v, want nil", err)
+	}
+	if want := []string{"*"}; !reflect.DeepEqual(conf.Namespaces, want) {
+		t.Errorf("Namespaces = %q, want %q", conf.Namespaces, want)
+	}
+}
+
+func TestParseConfigFilesMissing(t *testing.T) {
+	_, err := ParseConfigFiles(filepath.Join(t.TempDir(), "missing.toml"))
+	var configErr *ConfigError
+	if !errors.As(err, &configErr) {
+		t.Fatalf("ParseConfigFiles() error = %v, want a *ConfigError", err)
+	}
+	if !strings.Contains(err.Error(), "does not exist") {
+		t.Errorf("ParseConfigFiles() error = %q, want it to say the file does not exist", err)
+	}
+}
+
+func TestWithDefaults(t *testing.T) {
+	pattern := func(s string) TOMLRegexp {
+		return TOMLRegexp{Regexp: regexp.MustCompile(s)}
+	}
+	patterns := func(rs []TOMLRegexp) []string {
+		var s []string
+		for _, r := range rs {
+			s = append(s, r.Regexp.String())
+		}
+		return s
+	}
+	defaults := Defaults{
+		Include: []TOMLRegexp{pattern(`^v`)},
+		Exclude: []TOMLRegexp{pattern(`-rc`)},
+	}
+
+	tests := []struct {
+		name        string
+		image       WatchedImage
+		wantInclude []string
+		wantExclude []string
+	}{
+		{
+			name:        "no patterns",
+			image:       WatchedImage{},
+			wantInclude: []string{`^v`},
+			wantExclude: []string{`-rc`},
+		},
+		{
+			name:        "own include takes precedence",
+			image:       WatchedImage{Include: []TOMLRegexp{pattern(`-alpine$`)}, Exclude: []TOMLRegexp{pattern(`-beta`)}},
+			wantInclude: []string{`-alpine$`},
+			wantExclude: []string{`-beta`, `-rc`},
+		},
+		{
+			name:        "override",
+			image:       WatchedImage{OverrideDefaults: true, Exclude: []TOMLRegexp{pattern(`-beta`)}},
+			wantInclude: nil,
+			wantExclude: []string{`-beta`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.image.withDefaults(defaults)
+			if include := patterns(got.Include); !reflect.DeepEqual(include, tt.wantInclude) {
+				t.Errorf("Include = %q, want %q", include, tt.wantInclude)
+			}
+			if exclude := patterns(got.Exclude); !reflect.DeepEqual(exclude, tt.wantExclude) {
+				t.Errorf("Exclude = %q, want %q", exclude, tt.wantExclude)
+			}
+		})
+	}
+}
+
+func TestParseTag(t *testing.T) {
+	pattern := func(s string) TOMLRegexp {
+		return TOMLRegexp{Regexp: regexp.MustCompile(s)}
+	}
+
+	tests := []struct {
+		name    string
+		image   WatchedImage
+		tag     string
+		want    string
+		wantErr bool
+	}{
+		{name: "plain", tag: "1.2.3", want: "1.2.3"},
+		{name: "v prefixed", tag: "v1.2.3", want: "1.2.3"},
+		{name: "suffix without pattern", tag: "1.2.3-alpine", want: "1.2.3-alpine"},
+		{name: "suffix", image: WatchedImage{VersionPattern: pattern(`^(?P<version>[\d.]+)-alpine$`)}, tag: "1.2.3-alpine", want: "1.2.3"},
+		{name: "decorated", image: WatchedImage{VersionPattern: pattern(`^app-v(?P<version>[\d.]+)-prod$`)}, tag: "app-v1.2.3-prod", want: "1.2.3"},
+		{name: "tag prefix", image: WatchedImage{TagPrefix: "release-"}, tag: "release-1.2.3", want: "1.2.3"},
+		{name: "tag prefix and pattern", image: WatchedImage{TagPrefix: "release-", VersionPattern: pattern(`^(?P<version>[\d.]+)-debian`)}, tag: "release-1.2-debian-12", want: "1.2.0"},
+		{name: "pattern mismatch", image: WatchedImage{VersionPattern: pattern(`^app-v(?P<version>[\d.]+)-prod$`)}, tag: "app-v1.2.3-dev", wantErr: true},
+		{name: "tag prefix missing", image: WatchedImage{TagPrefix: "release-"}, tag: "1.2.3", wantErr: true},
+		{name: "not a version", tag: "stable", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.image.parseTag(tt.tag)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseTag(%q) = %s, want an error", tt.tag, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseTag(%q) error = %v", tt.tag, err)
+			}
+			if got.String() != tt.want {
+				t.Errorf("parseTag(%q) = %s, want %s", tt.tag, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseConfigFilesMerge(t *testing.T) {
+	dir := t.TempDir()
+	base := filepath.Join(dir, "base.toml")
+	override := filepath.Join(dir, "override.toml")
+	writeFile := func(path, content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile(base, `
+drivers = [ "docker", "podman" ]
+
+[matchImages]
+include = [ "^registry.internal/" ]
+
+[registries."registry.internal"]
+tagsPath = "api/%s/tags"
+
+[registries."ghcr.io"]
+token = "base"
+`)
+	writeFile(override, `
+drivers = [ "docker" ]
+
+[matchImages]
+exclude = [ "/legacy/" ]
+
+[registries."ghcr.io"]
+token = "override"
+
+[registries."quay.io"]
+insecureSkipVerify = true
+`)
+
+	conf, err := ParseConfigFiles(base, override)
+	if err != nil {
+		t.Fatalf("ParseConfigFiles() error = %v", err)
+	}
+
+	if want := []string{"docker"}; !reflect.DeepEqual(conf.Drivers, want) {
+		t.Errorf("Drivers = %q, want the override's %q", conf.Drivers, want)
+	}
+	if len(conf.MatchImages.Include) != 1 || len(conf.MatchImages.Exclude) != 1 {
+		t.Errorf("MatchImages = %+v, want the base's include and the override's exclude", conf.MatchImages)
+	}
+	want := map[string]RegistryConfig{
+		"registry.internal": {TagsPath: "api/%s/tags"},
+		"ghcr.io":           {Token: "override"},
+		"quay.io":           {InsecureSkipVerify: true},
+	}
+	if !reflect.DeepEqual(conf.Registries, want) {
+		t.Errorf("Registries = %+v, want %+v", conf.Registries, want)
+	}
+}
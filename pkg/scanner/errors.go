@@ -0,0 +1,77 @@
+package scanner
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PartialError is returned by Scan along with the results of the images that
+// could be checked when others couldn't, whose tags or version annotations
+// couldn't be read.
+type PartialError struct {
+	Images []*RegistryError
+}
+
+func (e *PartialError) Error() string {
+	msgs := make([]string, 0, len(e.Images))
+	for _, imageErr := range e.Images {
+		msgs = append(msgs, imageErr.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Unwrap returns the error of each image, so that errors.As finds them.
+func (e *PartialError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Images))
+	for _, imageErr := range e.Images {
+		errs = append(errs, imageErr)
+	}
+	return errs
+}
+
+// RegistryError is a failed request to the registry of an image. Such
+// failures, like rate limits, are often worth retrying.
+type RegistryError struct {
+	Image string
+	Err   error
+}
+
+func (e *RegistryError) Error() string {
+	return fmt.Sprintf("registry request for %s: %v", e.Image, e.Err)
+}
+
+func (e *RegistryError) Unwrap() error {
+	return e.Err
+}
+
+// NomadError is a failed request to the Nomad API within a namespace.
+type NomadError struct {
+	Namespace string
+	Err       error
+}
+
+func (e *NomadError) Error() string {
+	return fmt.Sprintf("nomad namespace %s: %v", e.Namespace, e.Err)
+}
+
+func (e *NomadError) Unwrap() error {
+	return e.Err
+}
+
+// ConfigError is an invalid config, which retrying won't fix. Path is the
+// file the error was found in, if known.
+type ConfigError struct {
+	Path string
+	Err  error
+}
+
+func (e *ConfigError) Error() string {
+	if e.Path == "" {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%s: %v", e.Path, e.Err)
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
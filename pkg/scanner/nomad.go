@@ -0,0 +1,573 @@
+package scanner
+
+import (
+	"fmt"
+	"log/slog"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/hashicorp/nomad/api"
+	"golang.org/x/sync/errgroup"
+)
+
+// jobStatusDead is the status of jobs with no allocations left to run.
+const jobStatusDead = "dead"
+
+type Instance struct {
+	Namespace string
+	Job       string
+	Group     string
+	Task      string
+	// Image has an empty tag when the task pins it by digest only.
+	Image reference.NamedTagged
+	// Digest is only known when the task pins its image as tag@digest or
+	// by digest only.
+	Digest string
+	// Count is the number of allocations, or job specs with SourceJobs,
+	// running the task with this image.
+	Count int
+	// SpecImage is the image of the job spec when it differs from the
+	// deployed Image, only set with Config.CompareDeployed.
+	SpecImage reference.NamedTagged
+	// ImageKey is the task config key Image was read from.
+	ImageKey string
+}
+
+func getInstances(client *api.Client, namespace string, conf Config, allocs *allocCache) ([]Instance, error) {
+	if namespace == "" {
+		namespace = "*"
+	}
+
+	conf.Logger.Debug("scanning namespace", "namespace", namespace, "source", SourceAllocs)
+
+	opt := api.QueryOptions{
+		Namespace:  namespace,
+		AllowStale: false,
+	}
+
+	allocations := client.Allocations()
+
+	alss, _, err := allocations.List(&opt)
+	if err != nil {
+		return nil, err
+	}
+
+	alss = filterAllocs(alss, conf.Jobs, conf.AllocStatuses)
+
+	// Each lookup writes to its own slot so the discovery order is kept
+	// regardless of which lookups finish first.
+	allocInstances := make([][]Instance, len(alss))
+
+	var g errgroup.Group
+	sem := make(chan struct{}, conf.MaxConcurrency)
+	cached := 0
+	for i, als := range alss {
+		i, als := i, als
+		if instances, ok := allocs.get(als.ID, als.ModifyIndex); ok {
+			allocInstances[i] = instances
+			cached++
+			continue
+		}
+
+		sem <- struct{}{}
+		g.Go(func() error {
+			defer func() { <-sem }()
+
+			alloc, _, err := allocations.Info(als.ID, &opt)
+			if err != nil {
+				return err
+			}
+
+			allocInstances[i] = getAllocInstances(alloc, conf)
+			allocs.put(als.ID, als.ModifyIndex, allocInstances[i])
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	conf.Logger.Debug("looked up allocations", "namespace", namespace, "fetched", len(alss)-cached, "cached", cached)
+
+	instances := make([]Instance, 0)
+	for _, allocInstance := range allocInstances {
+		instances = append(instances, allocInstance...)
+	}
+
+	return instances, nil
+}
+
+// filterAllocs drops the allocations of jobs not matching the job patterns,
+// and those whose client status isn't one of statuses, before their details
+// are looked up.
+func filterAllocs(alss []*api.AllocationListStub, patterns, statuses []string) []*api.AllocationListStub {
+	var filtered []*api.AllocationListStub
+	for _, als := range alss {
+		if jobMatches(als.JobID, patterns) && containsString(statuses, als.ClientStatus) {
+			filtered = append(filtered, als)
+		}
+	}
+	return filtered
+}
+
+func getAllocInstances(alloc *api.Allocation, conf Config) []Instance {
+	tg := alloc.GetTaskGroup()
+
+	var instances []Instance
+	for _, task := range tg.Tasks {
+		instance, ok := getTaskInstance(alloc.Namespace, alloc.Job, tg, task, conf)
+		if !ok {
+			continue
+		}
+		instances = append(instances, instance)
+	}
+
+	return instances
+}
+
+func getJobInstances(client *api.Client, namespace string, conf Config) ([]Instance, error) {
+	if namespace == "" {
+		namespace = "*"
+	}
+
+	conf.Logger.Debug("scanning namespace", "namespace", namespace, "source", SourceJobs)
+
+	jobs := client.Jobs()
+
+	stubs, _, err := jobs.List(&api.QueryOptions{
+		Namespace:  namespace,
+		AllowStale: false,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	stubs = filterJobs(stubs, conf.Jobs)
+	stubs = filterRunningJobs(stubs, conf.Logger)
+
+	jobInstances := make([][]Instance, len(stubs))
+
+	var g errgroup.Group
+	sem := make(chan struct{}, conf.MaxConcurrency)
+	for i, stub := range stubs {
+		i, stub := i, stub
+		sem <- struct{}{}
+		g.Go(func() error {
+			defer func() { <-sem }()
+
+			job, _, err := jobs.Info(stub.ID, &api.QueryOptions{
+				Namespace:  stub.Namespace,
+				AllowStale: false,
+			})
+			if err != nil {
+				return err
+			}
+
+			for _, tg := range job.TaskGroups {
+				for _, task := range tg.Tasks {
+					instance, ok := getTaskInstance(stub.Namespace, job, tg, task, conf)
+					if !ok {
+						continue
+					}
+					jobInstances[i] = append(jobInstances[i], instance)
+				}
+			}
+
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	instances := make([]Instance, 0)
+	for _, jobInstance := range jobInstances {
+		instances = append(instances, jobInstance...)
+	}
+
+	return instances, nil
+}
+
+// getDeployedInstances returns the instances of the job specs, replacing those
+// of tasks with allocations by the images the allocations actually run. Mid
+// rollout, such as with canaries, these can differ from the spec, which is
+// then kept as the instance's SpecImage.
+func getDeployedInstances(client *api.Client, namespace string, conf Config, allocs *allocCache) ([]Instance, error) {
+	specInstances, err := getJobInstances(client, namespace, conf)
+	if err != nil {
+		return nil, err
+	}
+
+	allocInstances, err := getInstances(client, namespace, conf, allocs)
+	if err != nil {
+		return nil, err
+	}
+
+	return reconcileInstances(conf.Logger, specInstances, allocInstances), nil
+}
+
+// reconcileInstances replaces each spec instance by the deployed instances of
+// the same task, if there are any.
+func reconcileInstances(logger *slog.Logger, specInstances, deployedInstances []Instance) []Instance {
+	taskKey := func(instance Instance) string {
+		return strings.Join([]string{instance.Namespace, instance.Job, instance.Group, instance.Task}, "/")
+	}
+
+	deployed := make(map[string][]Instance)
+	for _, instance := range deployedInstances {
+		deployed[taskKey(instance)] = append(deployed[taskKey(instance)], instance)
+	}
+
+	instances := make([]Instance, 0, len(specInstances))
+	for _, spec := range specInstances {
+		taskInstances, ok := deployed[taskKey(spec)]
+		if !ok {
+			instances = append(instances, spec)
+			continue
+		}
+
+		for _, instance := range taskInstances {
+			if instance.Image.String() != spec.Image.String() {
+				logger.Debug("deployed image differs from the job spec", "namespace", spec.Namespace, "job", spec.Job,
+					"group", spec.Group, "task", spec.Task, "deployed", instance.Image.String(), "spec", spec.Image.String())
+				instance.SpecImage = spec.Image
+			}
+			instances = append(instances, instance)
+		}
+	}
+
+	return instances
+}
+
+// filterJobs drops the jobs not matching the job patterns before their
+// details are looked up.
+func filterJobs(stubs []*api.JobListStub, patterns []string) []*api.JobListStub {
+	if len(patterns) == 0 {
+		return stubs
+	}
+
+	var filtered []*api.JobListStub
+	for _, stub := range stubs {
+		if jobMatches(stub.ID, patterns) {
+			filtered = append(filtered, stub)
+		}
+	}
+	return filtered
+}
+
+// filterRunningJobs returns the jobs that are neither stopped nor dead, as
+// job specs, unlike allocations, stay around after a job stops.
+func filterRunningJobs(stubs []*api.JobListStub, logger *slog.Logger) []*api.JobListStub {
+	var running []*api.JobListStub
+	for _, stub := range stubs {
+		if stub.Stop || stub.Status == jobStatusDead {
+			logger.Debug("skipping stopped job", "namespace", stub.Namespace, "job", stub.ID)
+			continue
+		}
+		running = append(running, stub)
+	}
+	return running
+}
+
+// jobMatches reports whether the job ID matches one of the glob patterns and
+// none of the patterns negated with a leading "!". Without any non-negated
+// patterns every job not excluded matches.
+func jobMatches(jobID string, patterns []string) bool {
+	included, hasIncludes := false, false
+	for _, pattern := range patterns {
+		if negated := strings.TrimPrefix(pattern, "!"); negated != pattern {
+			if ok, _ := path.Match(negated, jobID); ok {
+				return false
+			}
+			continue
+		}
+
+		hasIncludes = true
+		if ok, _ := path.Match(pattern, jobID); ok {
+			included = true
+		}
+	}
+	return included || !hasIncludes
+}
+
+// digestPinned is the image of a task pinned by digest only, such as
+// redis@sha256:..., which has no tag to compare.
+type digestPinned struct {
+	reference.Canonical
+}
+
+func (digestPinned) Tag() string {
+	return ""
+}
+
+func getTaskInstance(namespace string, job *api.Job, tg *api.TaskGroup, task *api.Task, conf Config) (Instance, bool) {
+	skip := func(reason string, args ...interface{}) (Instance, bool) {
+		args = append([]interface{}{"namespace", namespace, "job", *job.ID, "group", *tg.Name, "task", task.Name, "reason", reason}, args...)
+		conf.Logger.Debug("skipping task", args...)
+		return Instance{}, false
+	}
+
+	if !containsString(conf.Drivers, task.Driver) {
+		return skip("unwatched driver", "driver", task.Driver)
+	}
+
+	imageKey := conf.imageKey(task.Driver)
+	imageStr, ok := task.Config[imageKey].(string)
+	if !ok {
+		return skip("no image in task config", "key", imageKey)
+	}
+
+	if strings.Contains(imageStr, "${") {
+		imageStr, ok = interpolate(imageStr, getInterpolationVars(namespace, job, tg, task))
+		if !ok {
+			return skip("unresolved variable in image", "image", imageStr)
+		}
+	}
+
+	named, err := reference.ParseNormalizedNamed(imageStr)
+	if err != nil {
+		return skip("invalid image reference", "image", imageStr, "error", err)
+	}
+
+	image, ok := reference.TagNameOnly(named).(reference.NamedTagged)
+	if canonical, isCanonical := named.(reference.Canonical); !ok && isCanonical {
+		image = digestPinned{canonical}
+	} else if !ok {
+		return skip("image has no tag", "image", imageStr)
+	}
+
+	var digest string
+	if digested, ok := named.(reference.Digested); ok {
+		digest = digested.Digest().String()
+	}
+
+	return Instance{
+		Namespace: namespace,
+		Job:       *job.ID,
+		Group:     *tg.Name,
+		Task:      task.Name,
+		Image:     image,
+		Digest:    digest,
+		Count:     1,
+		ImageKey:  imageKey,
+	}, true
+}
+
+var interpolationRegexp = regexp.MustCompile(`\$\{([^}]+)\}`)
+
+// interpolate substitutes ${VAR} references in s, reporting false if any of
+// them couldn't be resolved.
+func interpolate(s string, vars map[string]string) (string, bool) {
+	resolved := true
+	result := interpolationRegexp.ReplaceAllStringFunc(s, func(match string) string {
+		value, ok := vars[match[2:len(match)-1]]
+		if !ok {
+			resolved = false
+		}
+		return value
+	})
+	return result, resolved
+}
+
+// getInterpolationVars returns the variables a task's config can be
+// interpolated with that are known without inspecting the client node: the
+// task env, the job, group and task meta, and Nomad's job runtime variables.
+func getInterpolationVars(namespace string, job *api.Job, tg *api.TaskGroup, task *api.Task) map[string]string {
+	vars := map[string]string{
+		"NOMAD_NAMESPACE":  namespace,
+		"NOMAD_JOB_ID":     *job.ID,
+		"NOMAD_GROUP_NAME": *tg.Name,
+		"NOMAD_TASK_NAME":  task.Name,
+	}
+	if job.Name != nil {
+		vars["NOMAD_JOB_NAME"] = *job.Name
+	}
+	if job.Region != nil {
+		vars["NOMAD_REGION"] = *job.Region
+	}
+
+	for _, meta := range []map[string]string{job.Meta, tg.Meta, task.Meta} {
+		for key, value := range meta {
+			vars["meta."+key] = value
+			vars["NOMAD_META_"+key] = value
+			vars["NOMAD_META_"+strings.ToUpper(key)] = value
+		}
+	}
+
+	for key, value := range task.Env {
+		vars[key] = value
+	}
+
+	return vars
+}
+
+// maxNamespaceConcurrency bounds how many namespaces are scanned at once.
+// Each of them looks up up to Config.MaxConcurrency allocations or jobs.
+const maxNamespaceConcurrency = 4
+
+func getAllInstances(client *api.Client, conf Config, allocs *allocCache) ([]Instance, error) {
+	namespaces := scanNamespaces(conf)
+
+	// Each namespace writes to its own slot so that the order of the
+	// configured namespaces is kept.
+	namespaceInstances := make([][]Instance, len(namespaces))
+
+	var g errgroup.Group
+	sem := make(chan struct{}, maxNamespaceConcurrency)
+	for i, namespace := range namespaces {
+		i, namespace := i, namespace
+		sem <- struct{}{}
+		g.Go(func() error {
+			defer func() { <-sem }()
+
+			var instances []Instance
+			var err error
+			if conf.Source == SourceJobs && conf.CompareDeployed {
+				instances, err = getDeployedInstances(client, namespace, conf, allocs)
+			} else if conf.Source == SourceJobs {
+				instances, err = getJobInstances(client, namespace, conf)
+			} else {
+				instances, err = getInstances(client, namespace, conf, allocs)
+			}
+			if err != nil {
+				return &NomadError{Namespace: namespace, Err: err}
+			}
+
+			namespaceInstances[i] = instances
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	var allInstances []Instance
+	for _, instances := range namespaceInstances {
+		allInstances = append(allInstances, instances...)
+	}
+
+	allInstances = dedupeInstances(allInstances)
+	if conf.NoSort {
+		return allInstances, nil
+	}
+
+	sortKeys, err := parseSortSpec(conf.Sort)
+	if err != nil {
+		return nil, err
+	}
+
+	sortInstances(allInstances, sortKeys)
+	return allInstances, nil
+}
+
+// scanNamespaces returns the namespaces to scan. The "*" wildcard already
+// spans every namespace, so the others are dropped rather than scanned, and
+// counted, twice.
+func scanNamespaces(conf Config) []string {
+	if !containsString(conf.Namespaces, "*") || len(conf.Namespaces) == 1 {
+		return conf.Namespaces
+	}
+
+	conf.Logger.Debug("ignoring namespaces covered by the wildcard", "namespaces", conf.Namespaces)
+	return []string{"*"}
+}
+
+// dedupeInstances merges the instances of the same task and image, such as
+// those of a group's many allocations, adding up their counts.
+func dedupeInstances(instances []Instance) []Instance {
+	seen := make(map[string]int)
+	deduped := make([]Instance, 0, len(instances))
+	for _, instance := range instances {
+		key := strings.Join([]string{
+			instance.Namespace,
+			instance.Job,
+			instance.Group,
+			instance.Task,
+			instance.Image.String(),
+			instance.Digest,
+		}, "/")
+		if i, ok := seen[key]; ok {
+			deduped[i].Count += instance.Count
+			continue
+		}
+
+		seen[key] = len(deduped)
+		deduped = append(deduped, instance)
+	}
+	return deduped
+}
+
+// defaultSort is the order instances are sorted in without Config.Sort.
+const defaultSort = "namespace:desc,job:desc,group:desc,task:desc"
+
+type sortKey struct {
+	column string
+	desc   bool
+}
+
+// parseSortSpec parses a comma separated list of instance columns, each
+// optionally followed by :asc (the default) or :desc.
+func parseSortSpec(spec string) ([]sortKey, error) {
+	var keys []sortKey
+	for _, field := range strings.Split(spec, ",") {
+		column, direction, _ := strings.Cut(strings.TrimSpace(field), ":")
+
+		switch column {
+		case "namespace", "job", "group", "task", "image":
+		default:
+			return nil, fmt.Errorf("unknown sort column %q", column)
+		}
+
+		var desc bool
+		switch direction {
+		case "", "asc":
+		case "desc":
+			desc = true
+		default:
+			return nil, fmt.Errorf("unknown sort direction %q", direction)
+		}
+
+		keys = append(keys, sortKey{column: column, desc: desc})
+	}
+	return keys, nil
+}
+
+func (k sortKey) value(instance Instance) string {
+	switch k.column {
+	case "namespace":
+		return instance.Namespace
+	case "job":
+		return instance.Job
+	case "group":
+		return instance.Group
+	case "task":
+		return instance.Task
+	default:
+		return instance.Image.String()
+	}
+}
+
+func sortInstances(instances []Instance, keys []sortKey) {
+	less := func(i, j int) bool {
+		for _, key := range keys {
+			a, b := key.value(instances[i]), key.value(instances[j])
+			if a == b {
+				continue
+			}
+			if key.desc {
+				return a > b
+			}
+			return a < b
+		}
+
+		return false
+	}
+
+	sort.SliceStable(instances, less)
+}
@@ -0,0 +1,189 @@
+package scanner
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/nomad/api"
+)
+
+func testConfig(t *testing.T, conf Config) Config {
+	t.Helper()
+
+	conf, err := conf.normalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conf
+}
+
+func TestGetTaskInstanceMalformedImage(t *testing.T) {
+	conf := testConfig(t, Config{})
+	job := &api.Job{ID: stringPtr("web")}
+	tg := &api.TaskGroup{Name: stringPtr("web")}
+
+	tests := []struct {
+		name   string
+		config map[string]interface{}
+	}{
+		{"missing", map[string]interface{}{}},
+		{"nil", map[string]interface{}{"image": nil}},
+		{"integer", map[string]interface{}{"image": 42}},
+		{"nil config", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			task := &api.Task{Name: "app", Driver: "docker", Config: tt.config}
+			if instance, ok := getTaskInstance("default", job, tg, task, conf); ok {
+				t.Errorf("getTaskInstance() = %+v, want the task skipped", instance)
+			}
+		})
+	}
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
+
+func TestScanNamespaces(t *testing.T) {
+	tests := []struct {
+		namespaces []string
+		want       []string
+	}{
+		{[]string{"default", "prod"}, []string{"default", "prod"}},
+		{[]string{"*"}, []string{"*"}},
+		{[]string{"*", "default"}, []string{"*"}},
+		{[]string{"prod", "*", "default"}, []string{"*"}},
+	}
+	for _, tt := range tests {
+		conf := testConfig(t, Config{Namespaces: tt.namespaces})
+		if got := scanNamespaces(conf); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("scanNamespaces(%q) = %q, want %q", tt.namespaces, got, tt.want)
+		}
+	}
+}
+
+// TestGetAllInstancesMixedNamespaces checks that the tasks of a wildcard
+// scan, which spans namespaces, are listed once each even when the other
+// configured namespaces overlap with it.
+func TestGetAllInstancesMixedNamespaces(t *testing.T) {
+	allocs := map[string]*api.Allocation{
+		"a1": testAllocation("a1", "default", "web", "nginx:1.25.0"),
+		"a2": testAllocation("a2", "prod", "web", "nginx:1.24.0"),
+	}
+
+	var listed []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/v1/allocations":
+			listed = append(listed, r.URL.Query().Get("namespace"))
+			stubs := make([]*api.AllocationListStub, 0, len(allocs))
+			for _, id := range []string{"a1", "a2"} {
+				alloc := allocs[id]
+				stubs = append(stubs, &api.AllocationListStub{
+					ID:           alloc.ID,
+					Namespace:    alloc.Namespace,
+					JobID:        alloc.JobID,
+					ClientStatus: alloc.ClientStatus,
+				})
+			}
+			json.NewEncoder(w).Encode(stubs)
+		case strings.HasPrefix(r.URL.Path, "/v1/allocation/"):
+			json.NewEncoder(w).Encode(allocs[strings.TrimPrefix(r.URL.Path, "/v1/allocation/")])
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	client, err := api.NewClient(&api.Config{Address: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conf := testConfig(t, Config{Namespaces: []string{"*", "default"}, NoSort: true})
+	instances, err := getAllInstances(client, conf, newAllocCache())
+	if err != nil {
+		t.Fatalf("getAllInstances() error = %v", err)
+	}
+
+	if want := []string{"*"}; !reflect.DeepEqual(listed, want) {
+		t.Errorf("listed allocations of namespaces %q, want %q", listed, want)
+	}
+
+	var got []string
+	for _, instance := range instances {
+		got = append(got, fmt.Sprintf("%s/%s %s x%d", instance.Namespace, instance.Job, instance.Image.Tag(), instance.Count))
+	}
+	if want := []string{"default/web 1.25.0 x1", "prod/web 1.24.0 x1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("getAllInstances() = %q, want %q", got, want)
+	}
+}
+
+func testAllocation(id, namespace, job, image string) *api.Allocation {
+	return &api.Allocation{
+		ID:           id,
+		Namespace:    namespace,
+		JobID:        job,
+		TaskGroup:    job,
+		ClientStatus: api.AllocClientStatusRunning,
+		Job: &api.Job{
+			ID:        stringPtr(job),
+			Namespace: stringPtr(namespace),
+			TaskGroups: []*api.TaskGroup{{
+				Name: stringPtr(job),
+				Tasks: []*api.Task{{
+					Name:   job,
+					Driver: "docker",
+					Config: map[string]interface{}{"image": image},
+				}},
+			}},
+		},
+	}
+}
+
+func TestGetJobInstancesSkipsStopped(t *testing.T) {
+	stubs := []*api.JobListStub{
+		{ID: "web", Namespace: "default", Status: "running"},
+		{ID: "old", Namespace: "default", Status: "dead"},
+		{ID: "stopping", Namespace: "default", Status: "running", Stop: true},
+	}
+
+	var fetched []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/v1/jobs":
+			json.NewEncoder(w).Encode(stubs)
+		case strings.HasPrefix(r.URL.Path, "/v1/job/"):
+			id := strings.TrimPrefix(r.URL.Path, "/v1/job/")
+			fetched = append(fetched, id)
+			json.NewEncoder(w).Encode(testAllocation(id, "default", id, "nginx:1.25.0").Job)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	client, err := api.NewClient(&api.Config{Address: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conf := testConfig(t, Config{Source: SourceJobs, MaxConcurrency: 1})
+	instances, err := getJobInstances(client, "default", conf)
+	if err != nil {
+		t.Fatalf("getJobInstances() error = %v", err)
+	}
+
+	if want := []string{"web"}; !reflect.DeepEqual(fetched, want) {
+		t.Errorf("fetched jobs %q, want %q", fetched, want)
+	}
+	if len(instances) != 1 || instances[0].Job != "web" {
+		t.Errorf("getJobInstances() = %+v, want only the web job", instances)
+	}
+}
@@ -0,0 +1,130 @@
+package scanner
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimits tracks the RateLimit-Limit and RateLimit-Remaining headers that
+// registries such as Docker Hub send, so that requests to a registry whose
+// limit is used up fail right away instead of with 429s.
+type rateLimits struct {
+	logger *slog.Logger
+
+	mu         sync.Mutex
+	registries map[string]rateLimit
+}
+
+// lowRateLimitRatio warns about rate limits once less than a tenth of the
+// requests are remaining.
+const lowRateLimitRatio = 10
+
+type rateLimit struct {
+	limit     int
+	remaining int
+	// resets is when the window of the limit ends, at the latest.
+	resets time.Time
+}
+
+func newRateLimits(logger *slog.Logger) *rateLimits {
+	return &rateLimits{
+		logger:     logger,
+		registries: make(map[string]rateLimit),
+	}
+}
+
+// check returns an error if the limit of the registry is used up.
+func (rl *rateLimits) check(registry string) error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	limit, ok := rl.registries[registry]
+	if !ok || limit.remaining > 0 || time.Now().After(limit.resets) {
+		return nil
+	}
+
+	return fmt.Errorf("rate limit of %d requests to %s is used up until %s at the latest", limit.limit, registry, limit.resets.Format(time.RFC3339))
+}
+
+// record keeps the rate limit of the registry from the response headers, if
+// it has them.
+func (rl *rateLimits) record(registry string, resp *http.Response) {
+	limit, window, ok := parseRateLimitHeader(resp.Header.Get("RateLimit-Limit"))
+	if !ok {
+		return
+	}
+	remaining, _, ok := parseRateLimitHeader(resp.Header.Get("RateLimit-Remaining"))
+	if !ok {
+		return
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	// Only warn once the limit gets low rather than on every request.
+	prev, seen := rl.registries[registry]
+	if low := remaining*lowRateLimitRatio <= limit; low && (!seen || prev.remaining*lowRateLimitRatio > prev.limit) {
+		rl.logger.Warn("registry rate limit almost used up", "registry", registry, "limit", limit, "remaining", remaining, "window", window)
+	} else {
+		rl.logger.Debug("registry rate limit", "registry", registry, "limit", limit, "remaining", remaining, "window", window)
+	}
+
+	rl.registries[registry] = rateLimit{
+		limit:     limit,
+		remaining: remaining,
+		resets:    time.Now().Add(window),
+	}
+}
+
+// rateLimitTransport fails requests to registries whose rate limit is used
+// up and records the limits of the responses, whichever API they are from.
+type rateLimitTransport struct {
+	base   http.RoundTripper
+	limits *rateLimits
+}
+
+func (t rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.limits.check(req.URL.Host); err != nil {
+		return nil, err
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	t.limits.record(req.URL.Host, resp)
+	return resp, nil
+}
+
+// parseRateLimitHeader parses a rate limit header value such as
+// "100;w=21600", a number of requests followed by the window in seconds.
+func parseRateLimitHeader(value string) (int, time.Duration, bool) {
+	if value == "" {
+		return 0, 0, false
+	}
+
+	count, params, _ := strings.Cut(value, ";")
+	n, err := strconv.Atoi(strings.TrimSpace(count))
+	if err != nil {
+		return 0, 0, false
+	}
+
+	var window time.Duration
+	for _, param := range strings.Split(params, ";") {
+		key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		if key != "w" {
+			continue
+		}
+		if seconds, err := strconv.Atoi(value); err == nil {
+			window = time.Duration(seconds) * time.Second
+		}
+	}
+
+	return n, window, true
+}
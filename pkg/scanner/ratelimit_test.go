@@ -0,0 +1,70 @@
+package scanner
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRateLimitTransport(t *testing.T) {
+	remaining := "2;w=60"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("RateLimit-Limit", "100;w=60")
+		w.Header().Set("RateLimit-Remaining", remaining)
+	}))
+	defer srv.Close()
+
+	var logs bytes.Buffer
+	limits := newRateLimits(slog.New(slog.NewTextHandler(&logs, nil)))
+	client := &http.Client{Transport: rateLimitTransport{base: http.DefaultTransport, limits: limits}}
+
+	get := func() error {
+		resp, err := client.Get(srv.URL + "/v2/library/redis/manifests/latest")
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	if err := get(); err != nil {
+		t.Fatalf("first request: %v", err)
+	}
+	if n := strings.Count(logs.String(), "almost used up"); n != 1 {
+		t.Errorf("logged %d low rate limit warnings, want 1:\n%s", n, logs.String())
+	}
+
+	remaining = "0;w=60"
+	if err := get(); err != nil {
+		t.Fatalf("second request: %v", err)
+	}
+	if n := strings.Count(logs.String(), "almost used up"); n != 1 {
+		t.Errorf("logged %d low rate limit warnings, want 1:\n%s", n, logs.String())
+	}
+
+	if err := get(); err == nil || !strings.Contains(err.Error(), "used up") {
+		t.Errorf("request after the limit was used up: error = %v, want it refused", err)
+	}
+}
+
+func TestParseRateLimitHeader(t *testing.T) {
+	tests := []struct {
+		value  string
+		n      int
+		window string
+		ok     bool
+	}{
+		{"100;w=21600", 100, "6h0m0s", true},
+		{"76", 76, "0s", true},
+		{"", 0, "0s", false},
+		{"many", 0, "0s", false},
+	}
+	for _, tt := range tests {
+		n, window, ok := parseRateLimitHeader(tt.value)
+		if n != tt.n || window.String() != tt.window || ok != tt.ok {
+			t.Errorf("parseRateLimitHeader(%q) = %d, %s, %t, want %d, %s, %t", tt.value, n, window, ok, tt.n, tt.window, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,696 @@
+package scanner
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+const (
+	defaultMaxTagPages = 100
+	defaultMaxRetries  = 3
+	defaultTimeout     = 30 * time.Second
+	defaultTagsPath    = "v2/%s/tags/list"
+
+	retryBaseDelay = 500 * time.Millisecond
+	retryMaxDelay  = 30 * time.Second
+)
+
+// RegistryClient lists the tags of a repository. By default the tags are
+// listed from the registry's HTTP API, see Config.RegistryClient.
+type RegistryClient interface {
+	Tags(ctx context.Context, repo name.Repository) ([]string, error)
+}
+
+type registryClient struct {
+	keychain   authn.Keychain
+	maxPages   int
+	maxRetries int
+	timeout    time.Duration
+	v1Fallback bool
+	insecure   []string
+	transports map[string]http.RoundTripper
+	registries map[string]RegistryConfig
+	tags       RegistryClient
+	cache      *tagCache
+	rateLimits *rateLimits
+	logger     *slog.Logger
+}
+
+func newRegistryClient(conf Config) (*registryClient, error) {
+	maxPages := conf.MaxTagPages
+	if maxPages <= 0 {
+		maxPages = defaultMaxTagPages
+	}
+
+	maxRetries := defaultMaxRetries
+	if conf.MaxRetries != nil {
+		maxRetries = *conf.MaxRetries
+	}
+
+	timeout := conf.RegistryTimeout.Duration
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+
+	base, err := newRegistryTokenKeychain(conf.Registries, getKeychain(conf.RegistryAuth))
+	if err != nil {
+		return nil, err
+	}
+
+	keychain, err := newImageKeychain(conf.Images, base)
+	if err != nil {
+		return nil, err
+	}
+
+	transports, err := getRegistryTransports(conf.Registries, conf.Logger)
+	if err != nil {
+		return nil, err
+	}
+
+	rc := &registryClient{
+		keychain:   keychain,
+		maxPages:   maxPages,
+		maxRetries: maxRetries,
+		timeout:    timeout,
+		v1Fallback: conf.V1Fallback,
+		insecure:   conf.InsecureRegistries,
+		transports: transports,
+		registries: conf.Registries,
+		cache:      newTagCache(conf.TagCacheTTL.Duration),
+		rateLimits: newRateLimits(conf.Logger),
+		logger:     conf.Logger,
+	}
+
+	rc.tags = conf.RegistryClient
+	if rc.tags == nil {
+		rc.tags = rc
+	}
+
+	return rc, nil
+}
+
+// getRegistryTransports returns the transports of the registries configured
+// to differ from http.DefaultTransport, which uses the proxy from the
+// environment and the system's certificate pool.
+func getRegistryTransports(registries map[string]RegistryConfig, logger *slog.Logger) (map[string]http.RoundTripper, error) {
+	transports := make(map[string]http.RoundTripper)
+	for host, registry := range registries {
+		if registry.Proxy == "" && registry.CAFile == "" && !registry.InsecureSkipVerify {
+			continue
+		}
+
+		t := http.DefaultTransport.(*http.Transport).Clone()
+
+		if registry.Proxy != "" {
+			proxyURL, err := url.Parse(registry.Proxy)
+			if err != nil {
+				return nil, fmt.Errorf("proxy of registry %s: %w", host, err)
+			}
+			t.Proxy = http.ProxyURL(proxyURL)
+		}
+
+		if registry.CAFile != "" || registry.InsecureSkipVerify {
+			tlsConfig, err := getTLSConfig(registry)
+			if err != nil {
+				return nil, fmt.Errorf("TLS config of registry %s: %w", host, err)
+			}
+			t.TLSClientConfig = tlsConfig
+		}
+
+		if registry.InsecureSkipVerify {
+			logger.Warn("TLS certificate verification is disabled, connections to the registry can be intercepted", "registry", host)
+		}
+
+		transports[host] = t
+	}
+	return transports, nil
+}
+
+// getTLSConfig returns a TLS config trusting the registry's CA bundle in
+// addition to the system's certificate pool.
+func getTLSConfig(registry RegistryConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: registry.InsecureSkipVerify}
+	if registry.CAFile == "" {
+		return tlsConfig, nil
+	}
+
+	pem, err := os.ReadFile(registry.CAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", registry.CAFile)
+	}
+
+	tlsConfig.RootCAs = pool
+	return tlsConfig, nil
+}
+
+// transport returns the base transport for requests to the registry, which
+// keeps track of its rate limit.
+func (rc *registryClient) transport(registry name.Registry) http.RoundTripper {
+	base, ok := rc.transports[registry.RegistryStr()]
+	if !ok {
+		base = http.DefaultTransport
+	}
+	return rateLimitTransport{base: base, limits: rc.rateLimits}
+}
+
+// getRepositoryTags returns every tag of the repository, from the tag cache if
+// it holds them.
+func (rc *registryClient) getRepositoryTags(ctx context.Context, repo name.Repository) ([]string, error) {
+	tags, ok := rc.cache.get(repo.String())
+	if ok {
+		return tags, nil
+	}
+
+	rc.logger.Debug("fetching tags", "repository", repo.String())
+
+	tags, err := rc.tags.Tags(ctx, repo)
+	if err != nil {
+		return nil, err
+	}
+	rc.cache.put(repo.String(), tags)
+
+	return tags, nil
+}
+
+// registryRepository returns the repository that is queried for the watched
+// image, which is on RegistryOverride if one is set.
+func registryRepository(watched WatchedImage) (name.Repository, error) {
+	repo, err := name.NewRepository(watched.Name)
+	if err != nil || watched.RegistryOverride == "" {
+		return repo, err
+	}
+
+	return name.NewRepository(watched.RegistryOverride + "/" + repo.RepositoryStr())
+}
+
+// repository returns the repository that is queried for the watched image,
+// using plain HTTP for insecure registries.
+func (rc *registryClient) repository(watched WatchedImage) (name.Repository, error) {
+	repo, err := registryRepository(watched)
+	if err != nil || !containsString(rc.insecure, repo.RegistryStr()) {
+		return repo, err
+	}
+
+	return name.NewRepository(repo.Name(), name.Insecure)
+}
+
+// Tags returns every tag of the repository from the registry's HTTP API.
+// Registries that only speak the v1 API are queried through it if v1Fallback
+// is set.
+func (rc *registryClient) Tags(ctx context.Context, repo name.Repository) ([]string, error) {
+	auth, err := rc.keychain.Resolve(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	tags, err := rc.listTagsV2(ctx, repo, auth)
+	var unauthorized *unauthorizedError
+	if auth == authn.Anonymous && errors.As(err, &unauthorized) {
+		tags, err = rc.retryUnauthorized(ctx, repo, unauthorized)
+	}
+	if rc.v1Fallback && isV2Unsupported(err) {
+		rc.logger.Debug("falling back to the v1 API", "repository", repo.String(), "error", err)
+		return rc.listTagsV1(ctx, repo, auth)
+	}
+	return tags, err
+}
+
+// retryUnauthorized retries listing the tags of a repository once after an
+// anonymous request was refused. Registries such as Docker Hub refuse
+// throttled anonymous clients with a 401 and a Retry-After header, which is
+// waited for. Without one the registry wants credentials, which the keychain
+// has none of, so the 401 is returned as is.
+func (rc *registryClient) retryUnauthorized(ctx context.Context, repo name.Repository, unauthorized *unauthorizedError) ([]string, error) {
+	delay, ok := parseRetryAfter(unauthorized.retryAfter)
+	if !ok {
+		rc.logger.Debug("anonymous tag listing unauthorized and no credentials configured", "repository", repo.String(), "challenge", unauthorized.wwwAuthenticate)
+		return nil, unauthorized
+	}
+
+	rc.logger.Debug("anonymous tag listing rate limited, retrying", "repository", repo.String(), "delay", delay)
+
+	timer := time.NewTimer(delay)
+	select {
+	case <-ctx.Done():
+		timer.Stop()
+		return nil, ctx.Err()
+	case <-timer.C:
+	}
+
+	tags, err := rc.listTagsV2(ctx, repo, authn.Anonymous)
+	if err == nil {
+		rc.logger.Info("listed tags after anonymous rate limit", "repository", repo.String())
+	}
+	return tags, err
+}
+
+// listTagsV2 returns every tag of the repository, following pagination.
+func (rc *registryClient) listTagsV2(ctx context.Context, repo name.Repository, auth authn.Authenticator) ([]string, error) {
+	// Setting up the transport pings the registry and fetches a token, which
+	// the client's timeout doesn't cover.
+	setupCtx, cancel := context.WithTimeout(ctx, rc.timeout)
+	defer cancel()
+
+	scopes := []string{repo.Scope(transport.PullScope)}
+	t, err := transport.NewWithContext(setupCtx, repo.Registry, auth, rc.transport(repo.Registry), scopes)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Transport: t, Timeout: rc.timeout}
+
+	tagsPath := defaultTagsPath
+	if registry, ok := rc.registries[repo.RegistryStr()]; ok && registry.TagsPath != "" {
+		tagsPath = strings.TrimPrefix(registry.TagsPath, "/")
+	}
+
+	path := fmt.Sprintf(tagsPath, repo.RepositoryStr())
+	next, err := url.Parse(fmt.Sprintf("%s://%s/%s", repo.Scheme(), repo.RegistryStr(), path))
+	if err != nil {
+		return nil, err
+	}
+
+	var tags []string
+	for page := 0; next != nil; page++ {
+		if page == rc.maxPages {
+			return nil, fmt.Errorf("tag list for %s exceeds %d pages", repo, rc.maxPages)
+		}
+
+		pageTags, nextURL, err := rc.getTagsPage(ctx, client, next)
+		if err != nil {
+			return nil, err
+		}
+
+		tags = append(tags, pageTags...)
+		next = nextURL
+	}
+
+	return tags, nil
+}
+
+func (rc *registryClient) getDigest(ctx context.Context, watched WatchedImage, tag string) (string, error) {
+	repo, err := rc.repository(watched)
+	if err != nil {
+		return "", err
+	}
+
+	return rc.resolveDigest(ctx, watched, repo.Tag(tag))
+}
+
+// pinnedDigest returns the digest a task pinned to digest is compared by. With
+// a platform set, a pinned multi-arch index is resolved to the platform's
+// manifest, so that it compares equal to what getDigest returns for the tag.
+func (rc *registryClient) pinnedDigest(ctx context.Context, watched WatchedImage, digest string) (string, error) {
+	if watched.Platform == "" {
+		return digest, nil
+	}
+
+	repo, err := rc.repository(watched)
+	if err != nil {
+		return "", err
+	}
+
+	return rc.resolveDigest(ctx, watched, repo.Digest(digest))
+}
+
+func (rc *registryClient) resolveDigest(ctx context.Context, watched WatchedImage, ref name.Reference) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, rc.timeout)
+	defer cancel()
+
+	opts := []remote.Option{remote.WithAuthFromKeychain(rc.keychain), remote.WithTransport(rc.transport(ref.Context().Registry)), remote.WithContext(ctx)}
+	if watched.Platform == "" {
+		desc, err := remote.Get(ref, opts...)
+		if err != nil {
+			return "", err
+		}
+
+		return desc.Digest.String(), nil
+	}
+
+	// The platform's manifest is picked from multi-arch indexes, and taken
+	// as is from single platform images.
+	platform, err := parsePlatform(watched.Platform)
+	if err != nil {
+		return "", err
+	}
+
+	img, err := remote.Image(ref, append(opts, remote.WithPlatform(platform))...)
+	if err != nil {
+		return "", err
+	}
+
+	digest, err := img.Digest()
+	if err != nil {
+		return "", err
+	}
+
+	return digest.String(), nil
+}
+
+// parsePlatform parses a platform such as linux/amd64 or linux/arm64/v8.
+func parsePlatform(s string) (v1.Platform, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return v1.Platform{}, fmt.Errorf("invalid platform %q, expected os/arch or os/arch/variant", s)
+	}
+
+	platform := v1.Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		platform.Variant = parts[2]
+	}
+	return platform, nil
+}
+
+// listTagsV1 returns the tags of the repository from the legacy v1 API,
+// which doesn't paginate and only supports basic authentication.
+func (rc *registryClient) listTagsV1(ctx context.Context, repo name.Repository, auth authn.Authenticator) ([]string, error) {
+	cfg, err := auth.Authorization()
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{Transport: rc.transport(repo.Registry), Timeout: rc.timeout}
+	if cfg.Username != "" || cfg.Password != "" {
+		client.Transport = &basicAuthTransport{username: cfg.Username, password: cfg.Password, inner: client.Transport}
+	}
+
+	rawURL := fmt.Sprintf("%s://%s/v1/repositories/%s/tags", repo.Scheme(), repo.RegistryStr(), repo.RepositoryStr())
+	resp, err := rc.getWithRetry(ctx, client, rawURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if err := transport.CheckError(resp, http.StatusOK); err != nil {
+		return nil, err
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	// Registries answer either with a map of tags to image IDs or with a
+	// list of tag objects.
+	var tagMap map[string]string
+	if err := json.Unmarshal(body, &tagMap); err == nil {
+		tags := make([]string, 0, len(tagMap))
+		for tag := range tagMap {
+			tags = append(tags, tag)
+		}
+		sort.Strings(tags)
+		return tags, nil
+	}
+
+	var tagList []struct {
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal(body, &tagList); err != nil {
+		return nil, fmt.Errorf("decoding v1 tag list of %s: %w", repo, err)
+	}
+
+	tags := make([]string, 0, len(tagList))
+	for _, tag := range tagList {
+		tags = append(tags, tag.Name)
+	}
+	return tags, nil
+}
+
+type basicAuthTransport struct {
+	username string
+	password string
+	inner    http.RoundTripper
+}
+
+func (t *basicAuthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.SetBasicAuth(t.username, t.password)
+	return t.inner.RoundTrip(req)
+}
+
+// getCreated returns the creation time from the config of the tag's image.
+// Registries don't record when a tag was pushed, but images are usually
+// pushed right after being built.
+func (rc *registryClient) getCreated(ctx context.Context, watched WatchedImage, tag string) (time.Time, error) {
+	repo, err := rc.repository(watched)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, rc.timeout)
+	defer cancel()
+
+	opts := []remote.Option{remote.WithAuthFromKeychain(rc.keychain), remote.WithTransport(rc.transport(repo.Registry)), remote.WithContext(ctx)}
+	if watched.Platform != "" {
+		platform, err := parsePlatform(watched.Platform)
+		if err != nil {
+			return time.Time{}, err
+		}
+		opts = append(opts, remote.WithPlatform(platform))
+	}
+
+	img, err := remote.Image(repo.Tag(tag), opts...)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return cfg.Created.Time, nil
+}
+
+// getAnnotation returns the annotation key of the tag's manifest, or the
+// empty string if the manifest doesn't have it.
+func (rc *registryClient) getAnnotation(ctx context.Context, watched WatchedImage, tag, key string) (string, error) {
+	repo, err := rc.repository(watched)
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, rc.timeout)
+	defer cancel()
+
+	desc, err := remote.Get(repo.Tag(tag), remote.WithAuthFromKeychain(rc.keychain), remote.WithTransport(rc.transport(repo.Registry)), remote.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+
+	// Image manifests and indexes both carry their annotations at the top
+	// level, so there's no need to tell them apart.
+	var manifest struct {
+		Annotations map[string]string `json:"annotations"`
+	}
+	if err := json.Unmarshal(desc.Manifest, &manifest); err != nil {
+		return "", err
+	}
+
+	return manifest.Annotations[key], nil
+}
+
+func (rc *registryClient) getTagsPage(ctx context.Context, client *http.Client, pageURL *url.URL) ([]string, *url.URL, error) {
+	resp, err := rc.getWithRetry(ctx, client, pageURL.String())
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	if err := transport.CheckError(resp, http.StatusOK); resp.StatusCode == http.StatusUnauthorized {
+		return nil, nil, &unauthorizedError{
+			err:             err,
+			wwwAuthenticate: resp.Header.Get("WWW-Authenticate"),
+			retryAfter:      resp.Header.Get("Retry-After"),
+		}
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	jsonResp := struct {
+		Tags []string `json:"tags"`
+	}{}
+	next, err := decodePage(resp, &jsonResp)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return jsonResp.Tags, next, nil
+}
+
+// decodePage decodes the JSON body of a paginated response into v, returning
+// the URL of the next page, or nil on the last one.
+func decodePage(resp *http.Response, v interface{}) (*url.URL, error) {
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return nil, err
+	}
+
+	return getNextPageURL(resp)
+}
+
+// unauthorizedError is a 401 response to a tag list request, keeping the
+// headers that tell a client needing credentials apart from a rate limited
+// one.
+type unauthorizedError struct {
+	err             error
+	wwwAuthenticate string
+	retryAfter      string
+}
+
+func (e *unauthorizedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *unauthorizedError) Unwrap() error {
+	return e.err
+}
+
+// getWithRetry performs a GET request, retrying rate limited and transient
+// server errors with exponential backoff and jitter.
+func (rc *registryClient) getWithRetry(ctx context.Context, client *http.Client, rawURL string) (*http.Response, error) {
+	backoff := retryBaseDelay
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		if !isRetryable(resp.StatusCode) || attempt >= rc.maxRetries {
+			return resp, nil
+		}
+
+		delay := backoff/2 + time.Duration(rand.Int63n(int64(backoff)))
+		if resp.StatusCode == http.StatusTooManyRequests {
+			if retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+				delay = retryAfter
+			}
+		}
+		resp.Body.Close()
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+
+		backoff *= 2
+		if backoff > retryMaxDelay {
+			backoff = retryMaxDelay
+		}
+	}
+}
+
+func isRetryable(statusCode int) bool {
+	switch statusCode {
+	case http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// parseRetryAfter parses a Retry-After header given either in seconds or as
+// an HTTP date. The delay is capped at retryMaxDelay, so that a registry
+// can't stall a scan for hours, and dates in the past mean no delay.
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		if seconds > int(retryMaxDelay/time.Second) {
+			return retryMaxDelay, true
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		delay := time.Until(date)
+		switch {
+		case delay < 0:
+			return 0, true
+		case delay > retryMaxDelay:
+			return retryMaxDelay, true
+		}
+		return delay, true
+	}
+
+	return 0, false
+}
+
+// getNextPageURL parses the Link header of a paginated registry response,
+// e.g. `</v2/library/ubuntu/tags/list?last=xyz&n=100>; rel="next"`, and
+// returns the absolute URL of the next page, or nil on the last page.
+func getNextPageURL(resp *http.Response) (*url.URL, error) {
+	link := resp.Header.Get("Link")
+	if link == "" {
+		return nil, nil
+	}
+
+	if link[0] != '<' {
+		return nil, fmt.Errorf("failed to parse link header: missing '<' in: %s", link)
+	}
+
+	end := strings.Index(link, ">")
+	if end == -1 {
+		return nil, fmt.Errorf("failed to parse link header: missing '>' in: %s", link)
+	}
+
+	if !strings.Contains(link[end:], `rel="next"`) {
+		return nil, nil
+	}
+
+	linkURL, err := url.Parse(link[1:end])
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Request.URL.ResolveReference(linkURL), nil
+}
+
+// isV2Unsupported reports whether err is a 404 without the structured errors
+// of the v2 API, which is what registries only speaking v1 respond with.
+func isV2Unsupported(err error) bool {
+	var terr *transport.Error
+	if !errors.As(err, &terr) {
+		return false
+	}
+	return terr.StatusCode == http.StatusNotFound && len(terr.Errors) == 0
+}
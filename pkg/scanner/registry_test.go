@@ -0,0 +1,260 @@
+package scanner
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// newTestRegistry serves handler as a plain HTTP registry and returns a
+// client for it along with a repository on it. The /v2/ ping is answered
+// without a challenge unless handler handles it.
+func newTestRegistry(t *testing.T, handler http.HandlerFunc) (*registryClient, name.Repository) {
+	t.Helper()
+
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	host := strings.TrimPrefix(srv.URL, "http://")
+	conf, err := Config{
+		InsecureRegistries: []string{host},
+		RegistryAuth:       RegistryAuth{DockerConfig: t.TempDir()},
+		MaxRetries:         new(int),
+		Logger:             slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}.normalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rc, err := newRegistryClient(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo, err := name.NewRepository(host+"/team/app", name.Insecure)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return rc, repo
+}
+
+func TestTagsCancelled(t *testing.T) {
+	rc, repo := newTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/" {
+			return
+		}
+		<-r.Context().Done()
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := rc.Tags(ctx, repo)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("Tags() error = %v, want %v", err, context.DeadlineExceeded)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Tags() didn't return after the context was cancelled")
+	}
+}
+
+func TestTags(t *testing.T) {
+	tests := []struct {
+		name string
+		// pages are served in turn, linked by Link headers.
+		pages [][]string
+		// refuseAnonymous is how many tag requests without credentials are
+		// refused with a 401, along with retryAfter if set.
+		refuseAnonymous int
+		retryAfter      string
+		want            []string
+		wantErr         bool
+		wantRequests    int
+	}{
+		{
+			name:         "single page",
+			pages:        [][]string{{"1.0.0", "1.1.0"}},
+			want:         []string{"1.0.0", "1.1.0"},
+			wantRequests: 1,
+		},
+		{
+			name:         "pagination",
+			pages:        [][]string{{"1.0.0"}, {"1.1.0", "1.2.0"}, {"2.0.0"}},
+			want:         []string{"1.0.0", "1.1.0", "1.2.0", "2.0.0"},
+			wantRequests: 3,
+		},
+		{
+			name:            "anonymous rate limited",
+			pages:           [][]string{{"1.0.0"}},
+			refuseAnonymous: 1,
+			retryAfter:      "0",
+			want:            []string{"1.0.0"},
+			wantRequests:    2,
+		},
+		{
+			name:            "no credentials",
+			pages:           [][]string{{"1.0.0"}},
+			refuseAnonymous: 1,
+			wantErr:         true,
+			wantRequests:    1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			requests, refused := 0, 0
+			rc, repo := newTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/v2/" {
+					w.Header().Set("WWW-Authenticate", `Basic realm="registry"`)
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+
+				mu.Lock()
+				defer mu.Unlock()
+				requests++
+
+				if refused < tt.refuseAnonymous {
+					refused++
+					if tt.retryAfter != "" {
+						w.Header().Set("Retry-After", tt.retryAfter)
+					}
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+
+				page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+				if page+1 < len(tt.pages) {
+					w.Header().Set("Link", fmt.Sprintf(`<%s?page=%d>; rel="next"`, r.URL.Path, page+1))
+				}
+				json.NewEncoder(w).Encode(map[string][]string{"tags": tt.pages[page]})
+			})
+
+			got, err := rc.Tags(context.Background(), repo)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Tags() error = %v, want error %t", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Tags() = %q, want %q", got, tt.want)
+			}
+			if requests != tt.wantRequests {
+				t.Errorf("made %d tag requests, want %d", requests, tt.wantRequests)
+			}
+		})
+	}
+}
+
+func TestPinnedDigest(t *testing.T) {
+	rc, repo := newTestRegistry(t, registry.New(registry.Logger(log.New(io.Discard, "", 0))).ServeHTTP)
+
+	amd64, err := random.Image(64, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	arm64, err := random.Image(64, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := mutate.AppendManifests(empty.Index,
+		mutate.IndexAddendum{Add: amd64, Descriptor: v1.Descriptor{Platform: &v1.Platform{OS: "linux", Architecture: "amd64"}}},
+		mutate.IndexAddendum{Add: arm64, Descriptor: v1.Descriptor{Platform: &v1.Platform{OS: "linux", Architecture: "arm64"}}},
+	)
+	if err := remote.WriteIndex(repo.Tag("1.0"), index); err != nil {
+		t.Fatal(err)
+	}
+
+	indexDigest, err := index.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	amd64Digest, err := amd64.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	watched := WatchedImage{Name: repo.Name(), Platform: "linux/amd64"}
+	latest, err := rc.getDigest(context.Background(), watched, "1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest != amd64Digest.String() {
+		t.Fatalf("getDigest() = %s, want the platform digest %s", latest, amd64Digest)
+	}
+
+	tests := []struct {
+		name     string
+		platform string
+		pinned   string
+		want     string
+	}{
+		{name: "index pinned", platform: "linux/amd64", pinned: indexDigest.String(), want: amd64Digest.String()},
+		{name: "platform pinned", platform: "linux/amd64", pinned: amd64Digest.String(), want: amd64Digest.String()},
+		{name: "no platform", pinned: indexDigest.String(), want: indexDigest.String()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			watched := WatchedImage{Name: repo.Name(), Platform: tt.platform}
+			got, err := rc.pinnedDigest(context.Background(), watched, tt.pinned)
+			if err != nil {
+				t.Fatalf("pinnedDigest() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("pinnedDigest() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		name   string
+		value  string
+		want   time.Duration
+		wantOK bool
+	}{
+		{name: "empty", value: ""},
+		{name: "seconds", value: "5", want: 5 * time.Second, wantOK: true},
+		{name: "seconds capped", value: "86400", want: retryMaxDelay, wantOK: true},
+		{name: "seconds overflowing", value: "9223372036854775807", want: retryMaxDelay, wantOK: true},
+		{name: "date capped", value: time.Now().Add(time.Hour).UTC().Format(http.TimeFormat), want: retryMaxDelay, wantOK: true},
+		{name: "date in the past", value: time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), want: 0, wantOK: true},
+		{name: "garbage", value: "soon"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseRetryAfter(tt.value)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("parseRetryAfter(%q) = %v, %v, want %v, %v", tt.value, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
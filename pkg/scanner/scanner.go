@@ -0,0 +1,1038 @@
+// Package scanner finds Nomad tasks running container images for which newer
+// versions have been published to their registry.
+package scanner
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/hashicorp/go-version"
+	"github.com/hashicorp/nomad/api"
+)
+
+// Scan lists the tasks running in the configured namespaces and compares the
+// images of the watched ones to the versions available in their registries.
+// If only the tags or annotations of some images couldn't be read, the
+// results of the others are returned along with a *PartialError.
+func Scan(ctx context.Context, client *api.Client, conf Config) ([]Result, error) {
+	s, err := New(client, conf)
+	if err != nil {
+		return nil, err
+	}
+	return s.Scan(ctx)
+}
+
+// Scanner runs repeated scans, keeping state such as cached registry tags
+// between them.
+type Scanner struct {
+	client   *api.Client
+	conf     Config
+	registry *registryClient
+	allocs   *allocCache
+	// unused holds the watched images no task ran in the last scan, and
+	// unwatched the images tasks ran that aren't watched.
+	unused    []string
+	unwatched []UnwatchedImage
+	// versions holds the parsed tags of each image in the last scan.
+	versions map[string]imageVersions
+}
+
+// New normalizes conf and returns a Scanner using it.
+func New(client *api.Client, conf Config) (*Scanner, error) {
+	conf, err := conf.normalize()
+	if err != nil {
+		return nil, err
+	}
+
+	// The registry client only fails on its configuration, such as an
+	// unset environment variable or an unreadable caFile.
+	registry, err := newRegistryClient(conf)
+	if err != nil {
+		return nil, &ConfigError{Err: err}
+	}
+
+	return &Scanner{
+		client:   client,
+		conf:     conf,
+		registry: registry,
+		allocs:   newAllocCache(),
+	}, nil
+}
+
+// Scan performs a single scan, see the package level Scan.
+func (s *Scanner) Scan(ctx context.Context) ([]Result, error) {
+	instances, err := getAllInstances(s.client, s.conf, s.allocs)
+	if err != nil {
+		return nil, err
+	}
+	s.allocs.prune()
+
+	s.unused = getUnusedImages(instances, s.conf.Images)
+
+	conf := s.conf
+	conf.Images = append(conf.Images[:len(conf.Images):len(conf.Images)], getMatchedImages(instances, conf)...)
+	conf.Images = append(conf.Images, getCatalogImages(ctx, conf, s.registry)...)
+	s.unwatched = getUnwatchedImages(instances, conf.Images)
+
+	images := make([]WatchedImage, 0, len(conf.Images))
+	for _, image := range conf.Images {
+		images = append(images, image.withDefaults(conf.Defaults))
+	}
+	conf.Images = images
+
+	parsedImageTags, imageErrs, err := getImageVersionMapping(ctx, conf.Images, s.registry)
+	if err != nil {
+		return nil, err
+	}
+	s.versions = parsedImageTags
+
+	checkLatestAliases(ctx, conf.Images, parsedImageTags, s.registry)
+
+	results, resultErrs := getResults(ctx, instances, conf, parsedImageTags, s.registry)
+	if partial := newPartialError(imageErrs, resultErrs); partial != nil {
+		return results, partial
+	}
+
+	return results, nil
+}
+
+// newPartialError returns a *PartialError for the images of the error maps,
+// or nil if there are none.
+func newPartialError(imageErrMaps ...map[string]error) *PartialError {
+	partial := &PartialError{}
+	for _, imageErrs := range imageErrMaps {
+		for image, err := range imageErrs {
+			partial.Images = append(partial.Images, &RegistryError{Image: image, Err: err})
+		}
+	}
+	if len(partial.Images) == 0 {
+		return nil
+	}
+
+	sort.Slice(partial.Images, func(i, j int) bool {
+		return partial.Images[i].Image < partial.Images[j].Image
+	})
+	return partial
+}
+
+// CacheStats returns how many tag lookups were served from the tag cache and
+// how many went to the registry.
+func (s *Scanner) CacheStats() (hits, misses int) {
+	return s.registry.cache.stats()
+}
+
+// UnusedImages returns the configured images that no task ran in the last
+// scan, which are often typos or leftovers of removed jobs.
+func (s *Scanner) UnusedImages() []string {
+	return s.unused
+}
+
+// UnwatchedImage is an image tasks run that isn't watched.
+type UnwatchedImage struct {
+	Image string `json:"image"`
+	// Tasks is the number of tasks running the image.
+	Tasks int `json:"tasks"`
+}
+
+// UnwatchedImages returns the images that tasks ran in the last scan without
+// being configured or matched by MatchImages, sorted by name.
+func (s *Scanner) UnwatchedImages() []UnwatchedImage {
+	return s.unwatched
+}
+
+// ImageVersions lists versions of an image, newest first.
+type ImageVersions struct {
+	Image    string   `json:"image"`
+	Versions []string `json:"versions"`
+}
+
+// NewestVersions returns up to n of the newest versions of each image whose
+// tags were listed in the last scan, sorted by image.
+func (s *Scanner) NewestVersions(n int) []ImageVersions {
+	newest := make([]ImageVersions, 0, len(s.versions))
+	for image, parsed := range s.versions {
+		versions := make([]string, 0, n)
+		for i := len(parsed.versions) - 1; i >= 0 && len(versions) < n; i-- {
+			versions = append(versions, parsed.tag(parsed.versions[i]))
+		}
+		newest = append(newest, ImageVersions{Image: image, Versions: versions})
+	}
+	sort.Slice(newest, func(i, j int) bool {
+		return newest[i].Image < newest[j].Image
+	})
+	return newest
+}
+
+// Result describes how a single task's image compares to the newest version
+// of that image.
+type Result struct {
+	Namespace       string `json:"namespace"`
+	Job             string `json:"job"`
+	Group           string `json:"group"`
+	Task            string `json:"task"`
+	Image           string `json:"image"`
+	Latest          string `json:"latest"`
+	Current         string `json:"current"`
+	UpdateAvailable bool   `json:"updateAvailable"`
+	Behind          int    `json:"behind"`
+	// UpdateType is the most significant version segment that changed.
+	UpdateType  UpdateType `json:"updateType"`
+	SkippedTags int        `json:"skippedTags"`
+	Count       int        `json:"count"`
+	// LatestTag and CurrentTag are the tags as published, whereas Latest
+	// and Current are normalized versions.
+	LatestTag  string `json:"latestTag"`
+	CurrentTag string `json:"currentTag"`
+	// DigestChanged is only set for rolling tags whose running digest is known.
+	DigestChanged *bool `json:"digestChanged,omitempty"`
+	// LatestDigest is the manifest digest of LatestTag, only resolved with
+	// Config.ResolveDigests and empty if that failed.
+	LatestDigest string `json:"latestDigest,omitempty"`
+	// LatestCreated is when the image of LatestTag was built, only read
+	// with Config.Since or Config.ImageAge for tasks with an update available.
+	LatestCreated *time.Time `json:"latestCreated,omitempty"`
+	// CurrentCreated is when the image of CurrentTag was built, only read
+	// with Config.ImageAge for tasks with an update available.
+	CurrentCreated *time.Time `json:"currentCreated,omitempty"`
+	// SpecImage is the image of the job spec when it differs from the
+	// deployed Image, only set with Config.CompareDeployed.
+	SpecImage string `json:"specImage,omitempty"`
+	// Warnings are problems found with the task's image that don't prevent
+	// comparing it, such as its tag having been deleted from the registry.
+	Warnings []string `json:"warnings,omitempty"`
+	// Pinned is set for tasks pinning their image by digest only, whose
+	// Current is that digest. They are only compared, by the digest of
+	// LatestTag, with Config.ResolveDigests.
+	Pinned bool `json:"pinned,omitempty"`
+
+	imageKey string
+}
+
+// Age returns how long before the latest image the task's image was built,
+// which is only known with Config.ImageAge.
+func (r Result) Age() (time.Duration, bool) {
+	if r.LatestCreated == nil || r.CurrentCreated == nil {
+		return 0, false
+	}
+	return r.LatestCreated.Sub(*r.CurrentCreated), true
+}
+
+// UpdateType classifies an update by the most significant part of the
+// version that changed, so that e.g. patch updates can be applied right away
+// while major ones are held for review.
+type UpdateType string
+
+const (
+	UpdateNone  UpdateType = "none"
+	UpdateMajor UpdateType = "major"
+	UpdateMinor UpdateType = "minor"
+	UpdatePatch UpdateType = "patch"
+	// UpdateDigest is a new image pushed under the same rolling tag.
+	UpdateDigest UpdateType = "digest"
+	// UpdateDate is a more recently pushed tag, picked by ComparePushDate,
+	// whose version isn't higher than the current one.
+	UpdateDate UpdateType = "date"
+)
+
+// getUpdateType compares the segments of current and latest. Updates that
+// only change segments past the third, or the prerelease, count as patches.
+func getUpdateType(current, latest *version.Version) UpdateType {
+	if !latest.GreaterThan(current) {
+		return UpdateNone
+	}
+
+	currentSegments, latestSegments := current.Segments(), latest.Segments()
+	switch {
+	case latestSegments[0] != currentSegments[0]:
+		return UpdateMajor
+	case latestSegments[1] != currentSegments[1]:
+		return UpdateMinor
+	default:
+		return UpdatePatch
+	}
+}
+
+// getMatchedImages returns watched images for the images of the instances
+// matching the MatchImages patterns that aren't watched already.
+func getMatchedImages(instances []Instance, conf Config) []WatchedImage {
+	if len(conf.MatchImages.Include) == 0 {
+		return nil
+	}
+
+	seen := make(map[string]bool)
+	for _, image := range conf.Images {
+		seen[image.Name] = true
+	}
+	byPath := watchedByPath(conf.Images)
+
+	var matched []WatchedImage
+	for _, instance := range instances {
+		name := instance.Image.Name()
+		if _, ok := byPath[reference.Path(instance.Image)]; seen[name] || ok {
+			continue
+		}
+		seen[name] = true
+
+		if isIncluded(name, conf.MatchImages.Include) && !isExcluded(name, conf.MatchImages.Exclude) {
+			conf.Logger.Debug("watching matched image", "image", name)
+			matched = append(matched, WatchedImage{Name: name})
+		}
+	}
+	return matched
+}
+
+// latestAlias is the floating tag compared to the newest version with
+// WatchedImage.CheckLatest.
+const latestAlias = "latest"
+
+// checkLatestAliases warns about the images with CheckLatest whose latest tag
+// doesn't point at the same manifest as their newest version.
+func checkLatestAliases(ctx context.Context, images []WatchedImage, parsedImageTags map[string]imageVersions, registry *registryClient) {
+	for _, image := range images {
+		parsed, ok := parsedImageTags[image.Name]
+		if !image.CheckLatest || !ok {
+			continue
+		}
+
+		newest := getNewestVersion(parsed.candidates)
+		if newest == nil {
+			continue
+		}
+
+		latestDigest, err := registry.getDigest(ctx, image, latestAlias)
+		if err != nil {
+			registry.logger.Warn("resolving digest failed", "image", image.Name, "tag", latestAlias, "error", err)
+			continue
+		}
+
+		newestTag := parsed.tag(newest)
+		newestDigest, err := registry.getDigest(ctx, image, newestTag)
+		if err != nil {
+			registry.logger.Warn("resolving digest failed", "image", image.Name, "tag", newestTag, "error", err)
+			continue
+		}
+
+		if latestDigest != newestDigest {
+			registry.logger.Warn("latest tag doesn't match the newest version", "image", image.Name,
+				"newest", newestTag, "latestDigest", latestDigest, "newestDigest", newestDigest)
+		}
+	}
+}
+
+// watchedByPath maps the repository paths of the images with
+// MatchAnyRegistry to their names.
+func watchedByPath(images []WatchedImage) map[string]string {
+	byPath := make(map[string]string)
+	for _, image := range images {
+		if !image.MatchAnyRegistry {
+			continue
+		}
+		if named, err := reference.ParseNormalizedNamed(image.Name); err == nil {
+			byPath[reference.Path(named)] = image.Name
+		}
+	}
+	return byPath
+}
+
+// tagWarnings returns the warnings about the tag the instance runs, which
+// is misleading to compare if it was removed from the registry.
+func tagWarnings(logger *slog.Logger, instance Instance, parsed imageVersions) []string {
+	if parsed.tags[instance.Image.Tag()] {
+		return nil
+	}
+
+	logger.Warn("current tag not found in the registry", "namespace", instance.Namespace, "job", instance.Job,
+		"group", instance.Group, "task", instance.Task, "image", instance.Image.String())
+	return []string{"current tag not found"}
+}
+
+// specImage returns the instance's SpecImage as a string, or "" if there is
+// none.
+func specImage(instance Instance) string {
+	if instance.SpecImage == nil {
+		return ""
+	}
+	return instance.SpecImage.String()
+}
+
+// watchedName returns the name of the watched image the instance runs, or ""
+// if it isn't watched.
+func watchedName(instance Instance, watched map[string]WatchedImage, byPath map[string]string) string {
+	if _, ok := watched[instance.Image.Name()]; ok {
+		return instance.Image.Name()
+	}
+	return byPath[reference.Path(instance.Image)]
+}
+
+// getUnusedImages returns the names of the images that none of the instances
+// run, in the order they are configured.
+func getUnusedImages(instances []Instance, images []WatchedImage) []string {
+	watched := make(map[string]WatchedImage)
+	for _, image := range images {
+		watched[image.Name] = image
+	}
+	byPath := watchedByPath(images)
+
+	used := make(map[string]bool)
+	for _, instance := range instances {
+		used[watchedName(instance, watched, byPath)] = true
+	}
+
+	var unused []string
+	for _, image := range images {
+		if !used[image.Name] {
+			unused = append(unused, image.Name)
+		}
+	}
+	return unused
+}
+
+// getUnwatchedImages returns the images the instances run that aren't among
+// images, with the number of tasks running each.
+func getUnwatchedImages(instances []Instance, images []WatchedImage) []UnwatchedImage {
+	watched := make(map[string]WatchedImage)
+	for _, image := range images {
+		watched[image.Name] = image
+	}
+	byPath := watchedByPath(images)
+
+	tasks := make(map[string]map[string]bool)
+	for _, instance := range instances {
+		if watchedName(instance, watched, byPath) != "" {
+			continue
+		}
+
+		name := instance.Image.Name()
+		if tasks[name] == nil {
+			tasks[name] = make(map[string]bool)
+		}
+		tasks[name][strings.Join([]string{instance.Namespace, instance.Job, instance.Group, instance.Task}, "/")] = true
+	}
+
+	unwatched := make([]UnwatchedImage, 0, len(tasks))
+	for name, imageTasks := range tasks {
+		unwatched = append(unwatched, UnwatchedImage{Image: name, Tasks: len(imageTasks)})
+	}
+	sort.Slice(unwatched, func(i, j int) bool {
+		return unwatched[i].Image < unwatched[j].Image
+	})
+	return unwatched
+}
+
+// getResults compares the instances to the versions of their images. The
+// errors of images whose annotations couldn't be read are returned separately,
+// and their tasks left out, so that the other images can still be checked.
+func getResults(ctx context.Context, instances []Instance, conf Config, parsedImageTags map[string]imageVersions, registry *registryClient) ([]Result, map[string]error) {
+	watched := make(map[string]WatchedImage)
+	for _, image := range conf.Images {
+		watched[image.Name] = image
+	}
+	byPath := watchedByPath(conf.Images)
+
+	digests := make(map[string]string)
+	getDigest := func(watch WatchedImage, tag string) (string, error) {
+		key := watch.Name + ":" + tag
+		if digest, ok := digests[key]; ok {
+			return digest, nil
+		}
+
+		digest, err := registry.getDigest(ctx, watch, tag)
+		if err != nil {
+			return "", err
+		}
+
+		digests[key] = digest
+		return digest, nil
+	}
+
+	getPinned := func(watch WatchedImage, digest string) (string, error) {
+		key := watch.Name + "@" + digest
+		if pinned, ok := digests[key]; ok {
+			return pinned, nil
+		}
+
+		pinned, err := registry.pinnedDigest(ctx, watch, digest)
+		if err != nil {
+			return "", err
+		}
+
+		digests[key] = pinned
+		return pinned, nil
+	}
+
+	created := make(map[string]time.Time)
+	getCreated := func(watch WatchedImage, tag string) (time.Time, error) {
+		key := watch.Name + ":" + tag
+		if t, ok := created[key]; ok {
+			return t, nil
+		}
+
+		t, err := registry.getCreated(ctx, watch, tag)
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		created[key] = t
+		return t, nil
+	}
+
+	// pushed caches the candidates of images compared by ComparePushDate,
+	// ordered by when they were built. Tags whose creation time can't be
+	// read are left out.
+	pushed := make(map[string][]pushedVersion)
+	getPushed := func(watch WatchedImage, parsed imageVersions) []pushedVersion {
+		if p, ok := pushed[watch.Name]; ok {
+			return p
+		}
+
+		p := make([]pushedVersion, 0, len(parsed.candidates))
+		for _, v := range parsed.candidates {
+			tag := parsed.tag(v)
+			t, err := getCreated(watch, tag)
+			if err != nil {
+				registry.logger.Warn("reading creation time failed", "image", watch.Name, "tag", tag, "error", err)
+				continue
+			}
+			p = append(p, pushedVersion{version: v, created: t})
+		}
+		sort.SliceStable(p, func(i, j int) bool {
+			return p[i].created.Before(p[j].created)
+		})
+
+		pushed[watch.Name] = p
+		return p
+	}
+
+	// annotatedVersions caches the versions read from manifest annotations,
+	// nil where the annotation is absent.
+	annotatedVersions := make(map[string]*version.Version)
+	getAnnotatedVersion := func(watch WatchedImage, tag string) (*version.Version, error) {
+		key := watch.Name + ":" + tag
+		if v, ok := annotatedVersions[key]; ok {
+			return v, nil
+		}
+
+		annotation, err := registry.getAnnotation(ctx, watch, tag, watch.VersionAnnotation)
+		if err != nil {
+			return nil, err
+		}
+
+		var v *version.Version
+		if annotation != "" {
+			v, err = version.NewVersion(annotation)
+			if err != nil {
+				return nil, fmt.Errorf("%s of %s:%s: %w", watch.VersionAnnotation, watch.Name, tag, err)
+			}
+		}
+
+		annotatedVersions[key] = v
+		return v, nil
+	}
+
+	results := make([]Result, 0)
+	imageErrs := make(map[string]error)
+	for _, instance := range instances {
+		imageName := watchedName(instance, watched, byPath)
+		parsed, ok := parsedImageTags[imageName]
+		if !ok {
+			continue
+		}
+		if _, failed := imageErrs[imageName]; failed {
+			continue
+		}
+
+		watch := watched[imageName]
+		pinned := instance.Image.Tag() == ""
+		// Tasks running the latest tag, which is also what images without
+		// a tag resolve to, have no version to compare.
+		runsLatest := instance.Image.Tag() == latestAlias && watch.VersionAnnotation == ""
+		if !pinned && (matchesAny(instance.Image.Tag(), watch.Rolling) || runsLatest && conf.LatestMode == LatestModeDigest) {
+			var digestChanged *bool
+			var latestDigest string
+			if instance.Digest != "" || conf.ResolveDigests {
+				var err error
+				var current string
+				latestDigest, err = getDigest(watch, instance.Image.Tag())
+				if err == nil && instance.Digest != "" {
+					current, err = getPinned(watch, instance.Digest)
+				}
+				if err != nil {
+					registry.logger.Warn("resolving digest failed", "image", instance.Image.Name(), "tag", instance.Image.Tag(), "error", err)
+				} else if instance.Digest != "" {
+					changed := latestDigest != current
+					digestChanged = &changed
+				}
+			}
+
+			result := Result{
+				Namespace:       instance.Namespace,
+				Job:             instance.Job,
+				Group:           instance.Group,
+				Task:            instance.Task,
+				Image:           instance.Image.Name(),
+				Latest:          instance.Image.Tag(),
+				Current:         instance.Image.Tag(),
+				LatestTag:       instance.Image.Tag(),
+				CurrentTag:      instance.Image.Tag(),
+				UpdateAvailable: digestChanged != nil && *digestChanged,
+				UpdateType:      UpdateNone,
+				SkippedTags:     len(parsed.skipped),
+				Count:           instance.Count,
+				DigestChanged:   digestChanged,
+				LatestDigest:    latestDigest,
+				SpecImage:       specImage(instance),
+				Warnings:        tagWarnings(registry.logger, instance, parsed),
+				imageKey:        instance.ImageKey,
+			}
+			if result.UpdateAvailable {
+				result.UpdateType = UpdateDigest
+			}
+			if digestChanged == nil {
+				// Without the running digest the task can't be told to be up
+				// to date.
+				result.Warnings = append(result.Warnings, "no digest to compare")
+			}
+			results = append(results, result)
+			continue
+		}
+
+		latest := getNewestVersion(parsed.candidates)
+		if watch.CompareStrategy == ComparePushDate {
+			latest = nil
+			if p := getPushed(watch, parsed); len(p) > 0 {
+				latest = p[len(p)-1].version
+			}
+		}
+		var latestTag string
+		if latest != nil {
+			latestTag = parsed.tag(latest)
+		}
+		if watch.VersionAnnotation != "" {
+			annotated, err := getAnnotatedVersion(watch, watch.AnnotationTag)
+			if err != nil {
+				registry.logger.Debug("skipping image", "image", imageName, "error", err)
+				imageErrs[imageName] = err
+				continue
+			}
+			if annotated != nil {
+				latest, latestTag = annotated, watch.AnnotationTag
+			}
+		}
+		if latest == nil {
+			registry.logger.Warn("skipping task", "namespace", instance.Namespace, "job", instance.Job, "group", instance.Group,
+				"task", instance.Task, "reason", "no versions of the image are left after filtering", "image", instance.Image.Name())
+			continue
+		}
+
+		if pinned {
+			result := Result{
+				Namespace:   instance.Namespace,
+				Job:         instance.Job,
+				Group:       instance.Group,
+				Task:        instance.Task,
+				Image:       instance.Image.Name(),
+				Latest:      latest.String(),
+				Current:     instance.Digest,
+				LatestTag:   latestTag,
+				UpdateType:  UpdateNone,
+				SkippedTags: len(parsed.skipped),
+				Count:       instance.Count,
+				Pinned:      true,
+				SpecImage:   specImage(instance),
+				imageKey:    instance.ImageKey,
+			}
+			if conf.ResolveDigests {
+				latestDigest, err := getDigest(watch, latestTag)
+				var current string
+				if err == nil {
+					current, err = getPinned(watch, instance.Digest)
+				}
+				if err != nil {
+					registry.logger.Warn("resolving digest failed", "image", instance.Image.Name(), "tag", latestTag, "error", err)
+				} else {
+					changed := latestDigest != current
+					result.UpdateAvailable, result.DigestChanged, result.LatestDigest = changed, &changed, latestDigest
+					if changed {
+						result.UpdateType = UpdateDigest
+					}
+				}
+			}
+			results = append(results, result)
+			continue
+		}
+
+		if runsLatest {
+			results = append(results, Result{
+				Namespace:   instance.Namespace,
+				Job:         instance.Job,
+				Group:       instance.Group,
+				Task:        instance.Task,
+				Image:       instance.Image.Name(),
+				Latest:      latest.String(),
+				Current:     latestAlias,
+				LatestTag:   latestTag,
+				CurrentTag:  latestAlias,
+				UpdateType:  UpdateNone,
+				SkippedTags: len(parsed.skipped),
+				Count:       instance.Count,
+				SpecImage:   specImage(instance),
+				Warnings:    append(tagWarnings(registry.logger, instance, parsed), "runs the latest tag, which has no version"),
+				imageKey:    instance.ImageKey,
+			})
+			continue
+		}
+
+		current, err := watch.parseTag(instance.Image.Tag())
+		if err != nil && watch.VersionAnnotation != "" {
+			annotated, annotationErr := getAnnotatedVersion(watch, instance.Image.Tag())
+			if annotationErr != nil {
+				registry.logger.Debug("skipping image", "image", imageName, "error", annotationErr)
+				imageErrs[imageName] = annotationErr
+				continue
+			}
+			if annotated != nil {
+				current, err = annotated, nil
+			} else {
+				err = fmt.Errorf("%s:%s is neither a version nor annotated with %s", instance.Image.Name(), instance.Image.Tag(), watch.VersionAnnotation)
+			}
+		}
+		if err != nil {
+			registry.logger.Warn("current tag isn't a version", "namespace", instance.Namespace, "job", instance.Job, "group", instance.Group,
+				"task", instance.Task, "image", instance.Image.String(), "error", err)
+			results = append(results, Result{
+				Namespace:   instance.Namespace,
+				Job:         instance.Job,
+				Group:       instance.Group,
+				Task:        instance.Task,
+				Image:       instance.Image.Name(),
+				Latest:      latest.String(),
+				Current:     instance.Image.Tag(),
+				LatestTag:   latestTag,
+				CurrentTag:  instance.Image.Tag(),
+				UpdateType:  UpdateNone,
+				SkippedTags: len(parsed.skipped),
+				Count:       instance.Count,
+				SpecImage:   specImage(instance),
+				Warnings:    append(tagWarnings(registry.logger, instance, parsed), "current tag isn't a version"),
+				imageKey:    instance.ImageKey,
+			})
+			continue
+		}
+
+		var latestDigest string
+		if conf.ResolveDigests {
+			latestDigest, err = getDigest(watch, latestTag)
+			if err != nil {
+				registry.logger.Warn("resolving digest failed", "image", instance.Image.Name(), "tag", latestTag, "error", err)
+			}
+		}
+
+		updateAvailable := latest.GreaterThan(current)
+		updateType := getUpdateType(current, latest)
+		behind := countNewer(parsed.candidates, current)
+		if watch.CompareStrategy == ComparePushDate {
+			created, err := getCreated(watch, instance.Image.Tag())
+			if err != nil {
+				registry.logger.Warn("reading creation time failed", "image", instance.Image.Name(), "tag", instance.Image.Tag(), "error", err)
+				updateAvailable, behind = latestTag != instance.Image.Tag(), 0
+			} else {
+				behind = countPushedAfter(getPushed(watch, parsed), created)
+				updateAvailable = behind > 0
+			}
+
+			// The push dates decide whether there's an update, the versions
+			// only what kind of update it is.
+			if !updateAvailable {
+				updateType = UpdateNone
+			} else if updateType == UpdateNone {
+				updateType = UpdateDate
+			}
+		}
+
+		var latestCreated, currentCreated *time.Time
+		if updateAvailable && (!conf.Since.IsZero() || conf.ImageAge) {
+			created, err := getCreated(watch, latestTag)
+			if err != nil {
+				registry.logger.Warn("reading creation time failed", "image", instance.Image.Name(), "tag", latestTag, "error", err)
+			} else if created.Before(conf.Since) {
+				continue
+			} else {
+				latestCreated = &created
+			}
+		}
+		if updateAvailable && conf.ImageAge {
+			created, err := getCreated(watch, instance.Image.Tag())
+			if err != nil {
+				registry.logger.Warn("reading creation time failed", "image", instance.Image.Name(), "tag", instance.Image.Tag(), "error", err)
+			} else {
+				currentCreated = &created
+			}
+		}
+
+		results = append(results, Result{
+			Namespace:       instance.Namespace,
+			Job:             instance.Job,
+			Group:           instance.Group,
+			Task:            instance.Task,
+			Image:           instance.Image.Name(),
+			Latest:          latest.String(),
+			Current:         current.String(),
+			LatestTag:       latestTag,
+			CurrentTag:      instance.Image.Tag(),
+			UpdateAvailable: updateAvailable,
+			Behind:          behind,
+			UpdateType:      updateType,
+			SkippedTags:     len(parsed.skipped),
+			Count:           instance.Count,
+			LatestDigest:    latestDigest,
+			LatestCreated:   latestCreated,
+			CurrentCreated:  currentCreated,
+			SpecImage:       specImage(instance),
+			Warnings:        tagWarnings(registry.logger, instance, parsed),
+			imageKey:        instance.ImageKey,
+		})
+	}
+
+	return results, imageErrs
+}
+
+// getImageTagMapping lists all tags of every watched image, returning the
+// errors of the images whose tags couldn't be listed separately so that the
+// other images can still be checked. Images listed from the same repository
+// share a single lookup.
+func getImageTagMapping(ctx context.Context, images []WatchedImage, registry *registryClient) (map[string][]string, map[string]error, error) {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+
+	imageTags := make(map[string][]string)
+	imageErrs := make(map[string]error)
+
+	repos := make(map[string]name.Repository)
+	watchers := make(map[string][]WatchedImage)
+	for _, watch := range images {
+		repo, err := registry.repository(watch)
+		if err != nil {
+			imageErrs[watch.Name] = err
+			continue
+		}
+
+		if _, ok := repos[repo.String()]; !ok {
+			repos[repo.String()] = repo
+		}
+		watchers[repo.String()] = append(watchers[repo.String()], watch)
+	}
+
+	for key, repo := range repos {
+		repo, watches := repo, watchers[key]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			tags, err := registry.getRepositoryTags(ctx, repo)
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			for _, watch := range watches {
+				if err != nil {
+					registry.logger.Debug("skipping image", "image", watch.Name, "error", err)
+					imageErrs[watch.Name] = err
+					continue
+				}
+
+				registry.logger.Debug("fetched tags", "image", watch.Name, "tags", len(tags))
+				imageTags[watch.Name] = tags
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	// Every image fails once the scan is cancelled, which isn't worth
+	// reporting image by image.
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	return imageTags, imageErrs, nil
+}
+
+// imageVersions holds the parsed versions of a watched image's tags along with
+// the tags that couldn't be parsed as versions. candidates are the versions
+// the latest version is chosen from. tags holds every tag of the image,
+// before filtering.
+type imageVersions struct {
+	versions   []*version.Version
+	candidates []*version.Version
+	skipped    []string
+	tags       map[string]bool
+	// versionTags maps the versions to the tags they were parsed from,
+	// which differ with a TagPrefix or VersionPattern.
+	versionTags map[*version.Version]string
+}
+
+// tag returns the tag the version was parsed from.
+func (parsed imageVersions) tag(v *version.Version) string {
+	if tag, ok := parsed.versionTags[v]; ok {
+		return tag
+	}
+	return v.Original()
+}
+
+func getImageVersionMapping(ctx context.Context, images []WatchedImage, registry *registryClient) (map[string]imageVersions, map[string]error, error) {
+	imageTags, imageErrs, err := getImageTagMapping(ctx, images, registry)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	watched := make(map[string]WatchedImage)
+	for _, image := range images {
+		watched[image.Name] = image
+	}
+
+	parsedImageTags := make(map[string]imageVersions)
+	for imageName, tags := range imageTags {
+		parsed := imageVersions{
+			tags:        make(map[string]bool, len(tags)),
+			versionTags: make(map[*version.Version]string),
+		}
+		for _, tag := range tags {
+			parsed.tags[tag] = true
+		}
+
+		watch := watched[imageName]
+		for _, tagStr := range filterTags(tags, watch.Include, watch.Exclude) {
+			ver, err := watch.parseTag(tagStr)
+			if err != nil {
+				parsed.skipped = append(parsed.skipped, tagStr)
+				continue
+			}
+
+			if ver.Prerelease() != "" && !watch.IncludePrereleases {
+				continue
+			}
+			if !watch.Constraint.Constraints.Check(ver) {
+				continue
+			}
+			parsed.versions = append(parsed.versions, ver)
+			parsed.versionTags[ver] = tagStr
+
+			if isIncluded(tagStr, watch.ComparisonInclude) && !isExcluded(tagStr, watch.ComparisonExclude) {
+				parsed.candidates = append(parsed.candidates, ver)
+			}
+		}
+
+		sort.Sort(version.Collection(parsed.versions))
+		sort.Sort(version.Collection(parsed.candidates))
+
+		if len(parsed.skipped) > 0 {
+			registry.logger.Debug("skipped unparseable tags", "image", imageName, "tags", parsed.skipped)
+		}
+
+		parsedImageTags[imageName] = parsed
+	}
+
+	return parsedImageTags, imageErrs, nil
+}
+
+// countNewer returns how many of the sorted versions are greater than v.
+func countNewer(versions []*version.Version, v *version.Version) int {
+	i := sort.Search(len(versions), func(i int) bool {
+		return versions[i].GreaterThan(v)
+	})
+	return len(versions) - i
+}
+
+// pushedVersion is a candidate version with the creation time of its image.
+type pushedVersion struct {
+	version *version.Version
+	created time.Time
+}
+
+// countPushedAfter returns how many of the versions, ordered by creation
+// time, were built after t.
+func countPushedAfter(versions []pushedVersion, t time.Time) int {
+	i := sort.Search(len(versions), func(i int) bool {
+		return versions[i].created.After(t)
+	})
+	return len(versions) - i
+}
+
+// getNewestVersion returns the greatest of versions, or nil if there are none.
+func getNewestVersion(versions []*version.Version) *version.Version {
+	var newestVersion *version.Version
+	for i, v := range versions {
+		if i == 0 {
+			newestVersion = v
+			continue
+		}
+
+		if v.GreaterThan(newestVersion) {
+			newestVersion = v
+		}
+	}
+
+	return newestVersion
+}
+
+func containsString(values []string, s string) bool {
+	for _, value := range values {
+		if value == s {
+			return true
+		}
+	}
+	return false
+}
+
+func isIncluded(s string, includes []TOMLRegexp) bool {
+	if len(includes) == 0 {
+		return true
+	}
+	for _, include := range includes {
+		if include.Regexp.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+func isExcluded(s string, excludes []TOMLRegexp) bool {
+	if len(excludes) == 0 {
+		return false
+	}
+	for _, exclude := range excludes {
+		if exclude.Regexp.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesAny(s string, patterns []TOMLRegexp) bool {
+	for _, pattern := range patterns {
+		if pattern.Regexp.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+func filterTags(tags []string, include, exclude []TOMLRegexp) []string {
+	filtered := make([]string, 0)
+	for _, tag := range tags {
+		if !isIncluded(tag, include) {
+			continue
+		} else if isExcluded(tag, exclude) {
+			continue
+		}
+		filtered = append(filtered, tag)
+	}
+	return filtered
+}
@@ -0,0 +1,266 @@
+package scanner
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/hashicorp/nomad/api"
+)
+
+// fakeRegistry lists the tags of repositories by their path, such as
+// library/redis.
+type fakeRegistry map[string][]string
+
+func (f fakeRegistry) Tags(ctx context.Context, repo name.Repository) ([]string, error) {
+	return f[repo.RepositoryStr()], nil
+}
+
+// scanInstances checks the instances against the tags of the fake registry,
+// returning the results and the log output. The images that couldn't be
+// checked are returned as a *PartialError.
+func scanInstances(t *testing.T, conf Config, tags fakeRegistry, instances ...Instance) ([]Result, string, error) {
+	t.Helper()
+
+	var logs bytes.Buffer
+	conf.Logger = slog.New(slog.NewTextHandler(&logs, nil))
+	conf.RegistryClient = tags
+	conf.RegistryAuth.DockerConfig = t.TempDir()
+	conf = testConfig(t, conf)
+
+	rc, err := newRegistryClient(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, _, err := getImageVersionMapping(context.Background(), conf.Images, rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results, imageErrs := getResults(context.Background(), instances, conf, parsed, rc)
+	if partial := newPartialError(imageErrs); partial != nil {
+		return results, logs.String(), partial
+	}
+	return results, logs.String(), nil
+}
+
+func testInstance(t *testing.T, task, image string) Instance {
+	t.Helper()
+
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return Instance{
+		Namespace: "default",
+		Job:       task,
+		Group:     task,
+		Task:      task,
+		Image:     reference.TagNameOnly(named).(reference.NamedTagged),
+		Count:     1,
+	}
+}
+
+func TestScanAllTagsFiltered(t *testing.T) {
+	conf := Config{Images: []WatchedImage{
+		{Name: "redis", Include: []TOMLRegexp{{Regexp: regexp.MustCompile(`^nothing$`)}}},
+		{Name: "postgres"},
+	}}
+	tags := fakeRegistry{
+		"library/redis":    {"7.0.0", "7.2.0"},
+		"library/postgres": {"15.0.0", "16.0.0"},
+	}
+
+	results, logs, err := scanInstances(t, conf, tags,
+		testInstance(t, "cache", "redis:7.0.0"),
+		testInstance(t, "db", "postgres:15.0.0"),
+	)
+	if err != nil {
+		t.Fatalf("getResults() error = %v", err)
+	}
+
+	if len(results) != 1 || results[0].Task != "db" || results[0].Latest != "16.0.0" {
+		t.Errorf("getResults() = %+v, want only the db task with latest 16.0.0", results)
+	}
+	if !strings.Contains(logs, "no versions of the image are left after filtering") {
+		t.Errorf("logs = %q, want a warning about the filtered redis tags", logs)
+	}
+}
+
+func TestScanUnversionedTags(t *testing.T) {
+	conf := Config{Images: []WatchedImage{{Name: "redis"}, {Name: "postgres"}}}
+	tags := fakeRegistry{
+		"library/redis":    {"7.0.0", "7.2.0", "stable", "latest"},
+		"library/postgres": {"15.0.0", "16.0.0"},
+	}
+
+	results, _, err := scanInstances(t, conf, tags,
+		testInstance(t, "cache", "redis:stable"),
+		testInstance(t, "queue", "redis"),
+		testInstance(t, "db", "postgres:15.0.0"),
+	)
+	if err != nil {
+		t.Fatalf("getResults() error = %v", err)
+	}
+
+	warnings := make(map[string][]string)
+	for _, result := range results {
+		warnings[result.Task] = result.Warnings
+		if result.Task != "db" && result.UpdateAvailable {
+			t.Errorf("task %s has an update available, want none", result.Task)
+		}
+	}
+	want := map[string][]string{
+		"cache": {"current tag isn't a version"},
+		"queue": {"no digest to compare"},
+		"db":    nil,
+	}
+	if !reflect.DeepEqual(warnings, want) {
+		t.Errorf("warnings = %q, want %q", warnings, want)
+	}
+}
+
+func TestNewConfigError(t *testing.T) {
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	conf := Config{
+		Registries:   map[string]RegistryConfig{"registry.example.com": {CAFile: caFile}},
+		RegistryAuth: RegistryAuth{DockerConfig: t.TempDir()},
+	}
+
+	_, err := New(nil, conf)
+	var configErr *ConfigError
+	if !errors.As(err, &configErr) {
+		t.Fatalf("New() error = %v, want a *ConfigError", err)
+	}
+	if !strings.Contains(err.Error(), "no certificates found") {
+		t.Errorf("New() error = %q, want it to name the bad caFile", err)
+	}
+}
+
+func TestPartialErrorAs(t *testing.T) {
+	var err error = &PartialError{Images: []*RegistryError{{Image: "redis", Err: errors.New("unauthorized")}}}
+
+	var registryErr *RegistryError
+	if !errors.As(err, &registryErr) || registryErr.Image != "redis" {
+		t.Fatalf("errors.As(%v) = %v, want the *RegistryError of redis", err, registryErr)
+	}
+}
+
+func TestScanAnnotationFailure(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	conf := Config{
+		Images: []WatchedImage{
+			{Name: host + "/team/app", VersionAnnotation: "org.opencontainers.image.version", AnnotationTag: "latest"},
+			{Name: "postgres"},
+		},
+		InsecureRegistries: []string{host},
+	}
+	tags := fakeRegistry{
+		"team/app":         {"1.0.0", "latest"},
+		"library/postgres": {"15.0.0", "16.0.0"},
+	}
+
+	results, _, err := scanInstances(t, conf, tags,
+		testInstance(t, "app", host+"/team/app:1.0.0"),
+		testInstance(t, "db", "postgres:15.0.0"),
+	)
+
+	var partial *PartialError
+	if !errors.As(err, &partial) || len(partial.Images) != 1 || partial.Images[0].Image != host+"/team/app" {
+		t.Fatalf("getResults() error = %v, want a *PartialError for the app image", err)
+	}
+	if len(results) != 1 || results[0].Task != "db" {
+		t.Errorf("getResults() = %+v, want only the db task", results)
+	}
+}
+
+// TestScanCompareDeployed checks that the spec image of tasks whose
+// deployment differs from the job spec is reported, also for tasks deployed
+// pinned by digest.
+func TestScanCompareDeployed(t *testing.T) {
+	conf := Config{Images: []WatchedImage{{Name: "redis"}}}
+	tags := fakeRegistry{"library/redis": {"7.0.0", "7.2.0"}}
+
+	tagged := testInstance(t, "tagged", "redis:7.0.0")
+	task := &api.Task{Name: "pinned", Driver: "docker", Config: map[string]interface{}{
+		"image": "redis@sha256:0123456789012345678901234567890123456789012345678901234567890123",
+	}}
+	pinned, ok := getTaskInstance("default", &api.Job{ID: stringPtr("pinned")}, &api.TaskGroup{Name: stringPtr("pinned")}, task, testConfig(t, Config{}))
+	if !ok {
+		t.Fatal("getTaskInstance() skipped the pinned task")
+	}
+	spec := testInstance(t, "spec", "redis:7.2.0").Image
+	tagged.SpecImage, pinned.SpecImage = spec, spec
+
+	results, _, err := scanInstances(t, conf, tags, tagged, pinned)
+	if err != nil {
+		t.Fatalf("getResults() error = %v", err)
+	}
+
+	specImages := make(map[string]string)
+	for _, result := range results {
+		specImages[result.Task] = result.SpecImage
+	}
+	want := map[string]string{"tagged": spec.String(), "pinned": spec.String()}
+	if !reflect.DeepEqual(specImages, want) {
+		t.Errorf("spec images = %q, want %q", specImages, want)
+	}
+}
+
+// TestScanRollingDigestFailure checks that a digest that can't be resolved
+// only leaves its task without a comparison instead of failing the scan.
+func TestScanRollingDigestFailure(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	conf := Config{
+		Images: []WatchedImage{
+			{Name: host + "/team/app", Rolling: []TOMLRegexp{{Regexp: regexp.MustCompile(`^stable$`)}}},
+			{Name: "postgres"},
+		},
+		InsecureRegistries: []string{host},
+	}
+	tags := fakeRegistry{
+		"team/app":         {"1.0.0", "stable"},
+		"library/postgres": {"15.0.0", "16.0.0"},
+	}
+
+	app := testInstance(t, "app", host+"/team/app:stable")
+	app.Digest = "sha256:0123456789012345678901234567890123456789012345678901234567890123"
+	results, logs, err := scanInstances(t, conf, tags, app, testInstance(t, "db", "postgres:15.0.0"))
+	if err != nil {
+		t.Fatalf("getResults() error = %v", err)
+	}
+
+	if len(results) != 2 {
+		t.Fatalf("getResults() = %+v, want results for both tasks", results)
+	}
+	for _, result := range results {
+		if result.Task == "app" && (result.DigestChanged != nil || !reflect.DeepEqual(result.Warnings, []string{"no digest to compare"})) {
+			t.Errorf("app result = %+v, want no digest comparison and a warning", result)
+		}
+	}
+	if !strings.Contains(logs, "resolving digest failed") {
+		t.Errorf("logs = %q, want a warning about the failed digest", logs)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"runtime/debug"
+)
+
+// Build information, set at build time with e.g.
+//
+//	go build -ldflags "-X main.version=v1.2.3 -X main.commit=$(git rev-parse HEAD) -X main.date=$(date -u +%FT%TZ)"
+//
+// Builds without them fall back to what the Go toolchain recorded.
+var (
+	version = ""
+	commit  = ""
+	date    = ""
+)
+
+// printVersion prints the version, commit and build date of the tool along
+// with the Go version it was built with.
+func printVersion(w io.Writer) error {
+	v, c, d := version, commit, date
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if v == "" {
+			v = info.Main.Version
+		}
+		for _, setting := range info.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && c == "":
+				c = setting.Value
+			case setting.Key == "vcs.time" && d == "":
+				d = setting.Value
+			}
+		}
+	}
+
+	if v == "" {
+		v = "(devel)"
+	}
+	if c == "" {
+		c = "unknown"
+	}
+	if d == "" {
+		d = "unknown"
+	}
+
+	_, err := fmt.Fprintf(w, "nomad-task-updates %s\ncommit: %s\nbuilt: %s\ngo: %s %s/%s\n",
+		v, c, d, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	return err
+}
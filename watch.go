@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/markpash/nomad-task-updates/pkg/scanner"
+)
+
+// clearScreen moves the cursor to the top left and clears the terminal so
+// that each table replaces the previous one.
+const clearScreen = "\033[H\033[2J"
+
+// watch rescans every -interval and re-renders the results until ctx is
+// cancelled. Failed scans are reported without stopping the loop.
+func watch(ctx context.Context, a *app) error {
+	ticker := time.NewTicker(a.opts.interval)
+	defer ticker.Stop()
+
+	for {
+		results, err := a.scan(ctx)
+		var partial *scanner.PartialError
+		if ctx.Err() != nil {
+			return nil
+		} else if err != nil && !errors.As(err, &partial) {
+			slog.Error("scan failed", "error", err)
+		} else {
+			if a.opts.format == formatTable {
+				fmt.Fprint(os.Stdout, clearScreen)
+			}
+			if err := render(os.Stdout, a.opts, results); err != nil {
+				return err
+			}
+			if partial != nil {
+				renderErrors(os.Stderr, a.opts, partial)
+			}
+			if unused := a.scanner.UnusedImages(); a.opts.reportUnused && len(unused) > 0 {
+				renderUnused(os.Stderr, a.opts, unused)
+			}
+			if unwatched := a.scanner.UnwatchedImages(); a.opts.reportUnwatched && len(unwatched) > 0 {
+				renderUnwatched(os.Stderr, a.opts, unwatched)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}